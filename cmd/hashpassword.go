@@ -0,0 +1,68 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var hashAlgorithm string
+
+// hashPasswordCmd prints the hash of a password, read from the standard
+// input when not given so it stays out of the shell history.
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password [password]",
+	Short: "Hash a password for --password or the config file users",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var password string
+		if len(args) == 1 {
+			password = args[0]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return err
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		if password == "" {
+			return errors.New("empty password")
+		}
+
+		hash, err := config.HashPassword(password, hashAlgorithm)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+
+		return nil
+	},
+}
+
+func init() {
+	hashPasswordCmd.Flags().StringVar(&hashAlgorithm, "algorithm", "bcrypt", `Hash algorithm, "bcrypt" or "argon2id"`)
+	rootCmd.AddCommand(hashPasswordCmd)
+}
@@ -19,15 +19,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/buga1234/iptv-proxy/pkg/filter"
 
 	"github.com/buga1234/iptv-proxy/pkg/server"
 
@@ -37,13 +41,21 @@ import (
 
 var cfgFile string
 
+// the user and password flags defaults, the proxy won't start with them
+const (
+	defaultUser     = "usertest"
+	defaultPassword = "passwordtest"
+)
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "iptv-proxy",
 	Short: "Reverse proxy on iptv m3u file and xtream codes server api",
 	Run: func(cmd *cobra.Command, args []string) {
-		// Запуск housekeeper в горутине
-		go housekeeper()
+		if (viper.GetString("user") == defaultUser || viper.GetString("password") == defaultPassword) && !viper.GetBool("allow-default-credentials") {
+			log.Fatal("[iptv-proxy] refusing to start with the default user or password, set --user and --password (or --allow-default-credentials)")
+		}
+
 		m3uURL := viper.GetString("m3u-url")
 		remoteHostURL, err := url.Parse(m3uURL)
 		if err != nil {
@@ -81,6 +93,9 @@ var rootCmd = &cobra.Command{
 			XtreamPassword:       config.CredentialString(xtreamPassword),
 			XtreamBaseURL:        xtreamBaseURL,
 			M3UCacheExpiration:   viper.GetInt("m3u-cache-expiration"),
+			EPGCacheExpiration:   viper.GetInt("epg-cache-expiration"),
+			EPGSources:           viper.GetStringSlice("epg-url"),
+			CatchupTimezone:      viper.GetString("catchup-timezone"),
 			User:                 config.CredentialString(viper.GetString("user")),
 			Password:             config.CredentialString(viper.GetString("password")),
 			AdvertisedPort:       viper.GetInt("advertised-port"),
@@ -89,6 +104,75 @@ var rootCmd = &cobra.Command{
 			CustomEndpoint:       viper.GetString("custom-endpoint"),
 			CustomId:             viper.GetString("custom-id"),
 			XtreamGenerateApiGet: viper.GetBool("xtream-api-get"),
+			XtreamM3uLive:        xtreamM3uContent("live"),
+			XtreamM3uVOD:         xtreamM3uContent("vod"),
+			XtreamM3uSeries:      xtreamM3uContent("series"),
+			XtreamEmulation:      viper.GetBool("xtream-emulation"),
+			StreamLimit:          viper.GetInt("stream-limit"),
+			HDHomeRun:            viper.GetBool("hdhr"),
+			HDHomeRunDeviceID:    viper.GetString("hdhr-device-id"),
+			HDHomeRunSSDP:        viper.GetBool("hdhr-ssdp"),
+			Stalker:              viper.GetBool("stalker"),
+			ImageProxy:           viper.GetBool("image-proxy"),
+			ImageCacheDir:        viper.GetString("image-cache-dir"),
+			ImageCacheSize:       viper.GetInt("image-cache-size"),
+			ImageSize:            viper.GetInt("image-size"),
+			VODCache:             viper.GetBool("vod-cache"),
+			VODCacheDir:          viper.GetString("vod-cache-dir"),
+			VODCacheSize:         viper.GetInt("vod-cache-size"),
+			DVR:                  viper.GetBool("dvr"),
+			DVRDir:               viper.GetString("dvr-dir"),
+			DVRFormat:            viper.GetString("dvr-format"),
+			DVRPadding:           viper.GetInt("dvr-padding"),
+			Timeshift:            viper.GetInt("timeshift"),
+			WorkDir:              viper.GetString("work-dir"),
+			WorkDirQuota:         viper.GetInt("work-dir-quota"),
+			WorkIdleTimeout:      viper.GetInt("work-idle-timeout"),
+			SignedURLs:           viper.GetBool("signed-urls"),
+			SignedURLsTTL:        viper.GetInt("signed-urls-ttl"),
+			SignedURLsIP:         viper.GetBool("signed-urls-ip"),
+			AuthMaxFailures:      viper.GetInt("auth-max-failures"),
+			AuthLockout:          viper.GetInt("auth-lockout"),
+			AuthLockoutMax:       viper.GetInt("auth-lockout-max"),
+			RateLimit:            viper.GetInt("rate-limit"),
+			RateLimitBurst:       viper.GetInt("rate-limit-burst"),
+			Metrics:              viper.GetBool("metrics"),
+			Allow:                viper.GetStringSlice("allow"),
+			Deny:                 viper.GetStringSlice("deny"),
+			AllowCountries:       viper.GetStringSlice("allow-country"),
+			DenyCountries:        viper.GetStringSlice("deny-country"),
+			GeoIPDatabase:        viper.GetString("geoip-db"),
+			TrustedProxies:       viper.GetStringSlice("trusted-proxy"),
+			TLSCert:              viper.GetString("tls-cert"),
+			TLSKey:               viper.GetString("tls-key"),
+			TLSClientCA:          viper.GetString("tls-client-ca"),
+			TLSRequireClientCert: viper.GetBool("tls-client-cert-required"),
+			HTTPRedirectPort:     viper.GetInt("http-redirect-port"),
+			ShutdownTimeout:      viper.GetInt("shutdown-timeout"),
+		}
+
+		var rules filter.Rules
+		if err := viper.UnmarshalKey("filters", &rules); err != nil {
+			log.Fatal(err)
+		}
+		if conf.Filter, err = filter.New(rules); err != nil {
+			log.Fatal(err)
+		}
+
+		var users []config.UserAccount
+		if err := viper.UnmarshalKey("users", &users); err != nil {
+			log.Fatal(err)
+		}
+		conf.Users = config.NewUserStore(append([]config.UserAccount{{
+			Username: conf.User,
+			Password: conf.Password,
+			MACs:     viper.GetStringSlice("stalker-mac"),
+			URLKey:   config.CredentialString(viper.GetString("url-key")),
+		}}, users...)...)
+
+		// the URLs follow the listener
+		if conf.TLSCert != "" {
+			conf.HTTPS = true
 		}
 
 		if conf.AdvertisedPort == 0 {
@@ -100,7 +184,14 @@ var rootCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		if e := server.Serve(); e != nil {
+		// a second signal kills the proxy without waiting for the shutdown
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+
+		if e := server.Serve(ctx); e != nil {
 			log.Fatal(e)
 		}
 
@@ -131,19 +222,88 @@ func init() {
 	rootCmd.Flags().Int("advertised-port", 0, "Port to expose the IPTV file and xtream (by default, it's taking value from port) useful to put behind a reverse proxy")
 	rootCmd.Flags().String("hostname", "", "Hostname or IP to expose the IPTVs endpoints")
 	rootCmd.Flags().BoolP("https", "", false, "Activate https for urls proxy")
-	rootCmd.Flags().String("user", "usertest", "User auth to access proxy (m3u/xtream)")
-	rootCmd.Flags().String("password", "passwordtest", "Password auth to access proxy (m3u/xtream)")
+	rootCmd.Flags().String("user", defaultUser, "User auth to access proxy (m3u/xtream)")
+	rootCmd.Flags().String("password", defaultPassword, "Password auth to access proxy (m3u/xtream), plain or hashed with the hash-password command")
+	rootCmd.Flags().BoolP("allow-default-credentials", "", false, "Start even with the default user or password")
 	rootCmd.Flags().String("xtream-user", "", "Xtream-code user login")
 	rootCmd.Flags().String("xtream-password", "", "Xtream-code password login")
 	rootCmd.Flags().String("xtream-base-url", "", "Xtream-code base url e.g(http://expample.tv:8080)")
 	rootCmd.Flags().Int("m3u-cache-expiration", 1, "M3U cache expiration in hour")
+	rootCmd.Flags().StringSlice("epg-url", nil, `XMLTV guide url or file, can be repeated e.g: "http://example.com/guide.xml.gz"`)
+	rootCmd.Flags().Int("epg-cache-expiration", 12, "EPG cache expiration in hour, the guide is refreshed in background at this interval")
+	rootCmd.Flags().String("catchup-timezone", "", `Timezone of the m3u provider catch-up URLs e.g: "Europe/Paris" (by default, the local one)`)
 	rootCmd.Flags().BoolP("xtream-api-get", "", false, "Generate get.php from xtream API instead of get.php original endpoint")
+	rootCmd.Flags().BoolP("xtream-api-get-live", "", true, "Include live streams in the m3u generated from xtream API")
+	rootCmd.Flags().String("xtream-api-get-live-categories", "", "Regexp of the live categories to include in the m3u generated from xtream API (by default, all)")
+	rootCmd.Flags().BoolP("xtream-api-get-vod", "", false, "Include movies in the m3u generated from xtream API")
+	rootCmd.Flags().String("xtream-api-get-vod-categories", "", "Regexp of the movie categories to include in the m3u generated from xtream API (by default, all)")
+	rootCmd.Flags().BoolP("xtream-api-get-series", "", false, "Include series episodes in the m3u generated from xtream API")
+	rootCmd.Flags().String("xtream-api-get-series-categories", "", "Regexp of the series categories to include in the m3u generated from xtream API (by default, all)")
+	rootCmd.Flags().Int("stream-limit", 0, "Maximum concurrent upstream streams, 0 for unlimited")
+	rootCmd.Flags().BoolP("hdhr", "", false, "Emulate an HDHomeRun tuner for Plex, Jellyfin and Emby")
+	rootCmd.Flags().String("hdhr-device-id", "", "HDHomeRun device ID, 8 hexadecimal characters (by default, it's derived from hostname and port)")
+	rootCmd.Flags().BoolP("hdhr-ssdp", "", false, "Announce the HDHomeRun tuner on the LAN with SSDP")
+	rootCmd.Flags().BoolP("stalker", "", false, "Emulate a Stalker middleware portal for MAG set-top boxes")
+	rootCmd.Flags().StringSlice("stalker-mac", nil, "MAC address of a MAG set-top box of the main user, can be repeated (other users are set in the config file)")
+	rootCmd.Flags().BoolP("xtream-emulation", "", false, "Emulate an xtream server (client API) on top of the m3u playlist when there is no xtream backend")
+	rootCmd.Flags().BoolP("image-proxy", "", false, "Serve the channel logos and posters through the proxy")
+	rootCmd.Flags().String("image-cache-dir", filepath.Join(os.TempDir(), "iptv-proxy-images"), "Directory of the image proxy cache")
+	rootCmd.Flags().Int("image-cache-size", 512, "Maximum size of the image proxy cache in MB (0 for no limit)")
+	rootCmd.Flags().Int("image-size", 0, "Resize the proxied images to fit this size in pixels (0 keeps the original size)")
+	rootCmd.Flags().BoolP("vod-cache", "", false, "Cache the xtream movies and series episodes on disk")
+	rootCmd.Flags().String("vod-cache-dir", filepath.Join(os.TempDir(), "iptv-proxy-vod"), "Directory of the VOD cache")
+	rootCmd.Flags().Int("vod-cache-size", 20, "Maximum size of the VOD cache in GB (0 for no limit)")
+	rootCmd.Flags().BoolP("dvr", "", false, "Record live channels on schedules")
+	rootCmd.Flags().String("dvr-dir", "recordings", "Directory of the recordings")
+	rootCmd.Flags().String("dvr-format", "ts", `Recordings format, "ts" or "mp4" (remuxed by ffmpeg)`)
+	rootCmd.Flags().Int("dvr-padding", 2, "Minutes recorded before and after the programmes")
+	rootCmd.Flags().Int("timeshift", 0, "Minutes of the watched live channels kept on disk to pause and rewind them (0 to disable)")
+	rootCmd.Flags().String("work-dir", "hlsdownloads", "Work directory of the HLS transcodings and timeshift buffers (a tmpfs is fine)")
+	rootCmd.Flags().Int("work-dir-quota", 0, "Maximum size of the work directory in MB, the oldest idle sessions are closed beyond (0 for no limit)")
+	rootCmd.Flags().Int("work-idle-timeout", 2, "Minutes before closing a transcoding or a timeshift buffer nobody requests")
+	rootCmd.Flags().BoolP("signed-urls", "", false, "Replace the credentials of the playlists stream URLs with signed, expiring tokens")
+	rootCmd.Flags().Int("signed-urls-ttl", 24, "Signed stream URLs validity in hour")
+	rootCmd.Flags().BoolP("signed-urls-ip", "", false, "Bind the signed stream URLs to the client IP")
+	rootCmd.Flags().String("url-key", "", "Key signing the main user stream URLs, change it to revoke them (by default, the password)")
+	rootCmd.Flags().Int("auth-max-failures", 5, "Failed authentications before locking out the client IP and the username (0 to disable)")
+	rootCmd.Flags().Int("auth-lockout", 1, "Minutes of the first lockout, doubled after each other failure")
+	rootCmd.Flags().Int("auth-lockout-max", 60, "Maximum lockout in minutes, the failures are forgotten after as long without any")
+	rootCmd.Flags().Int("rate-limit", 120, "Playlist and API requests per minute per client IP (0 for no limit)")
+	rootCmd.Flags().Int("rate-limit-burst", 30, "Playlist and API requests allowed at once per client IP")
+	rootCmd.Flags().StringSlice("allow", nil, "Network (CIDR or IP) allowed to reach the proxy, can be repeated (by default, all)")
+	rootCmd.Flags().StringSlice("deny", nil, "Network (CIDR or IP) denied, can be repeated")
+	rootCmd.Flags().StringSlice("allow-country", nil, "Country (ISO code) allowed to reach the proxy, can be repeated (needs --geoip-db)")
+	rootCmd.Flags().StringSlice("deny-country", nil, "Country (ISO code) denied, can be repeated (needs --geoip-db)")
+	rootCmd.Flags().String("geoip-db", "", "MaxMind format countries database file, e.g. GeoLite2-Country.mmdb")
+	rootCmd.Flags().StringSlice("trusted-proxy", nil, "Reverse proxy (CIDR or IP) whose X-Forwarded-For header is trusted, can be repeated (by default, none)")
+	rootCmd.Flags().String("tls-cert", "", "Certificate file (PEM) to serve HTTPS, reloaded when it changes")
+	rootCmd.Flags().String("tls-key", "", "Private key file (PEM) of the certificate")
+	rootCmd.Flags().String("tls-client-ca", "", "CA file (PEM) of the trusted devices client certificates, they escape the access rules and rate limits")
+	rootCmd.Flags().BoolP("tls-client-cert-required", "", false, "Only accept the devices with a client certificate")
+	rootCmd.Flags().Int("http-redirect-port", 0, "Port redirecting plain HTTP to HTTPS (0 to disable)")
+	rootCmd.Flags().Int("shutdown-timeout", 5, "Seconds given to the requests in progress to finish on SIGTERM or SIGINT")
+	rootCmd.Flags().BoolP("metrics", "", false, "Serve the authentication and rate limit metrics on /metrics, in the Prometheus format")
 
 	if e := viper.BindPFlags(rootCmd.Flags()); e != nil {
 		log.Fatal("error binding PFlags to viper")
 	}
 }
 
+// xtreamM3uContent reads the xtream-api-get-<kind> flags.
+func xtreamM3uContent(kind string) config.XtreamM3uContent {
+	content := config.XtreamM3uContent{Enabled: viper.GetBool("xtream-api-get-" + kind)}
+
+	if expr := viper.GetString("xtream-api-get-" + kind + "-categories"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("invalid --xtream-api-get-%s-categories: %v", kind, err)
+		}
+		content.Categories = re
+	}
+
+	return content
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -172,51 +332,3 @@ func initConfig() {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
-
-func housekeeper() {
-	ticker := time.NewTicker(time.Minute) // Проверка каждую минуту
-	defer ticker.Stop()
-
-	for range ticker.C {
-		dir := "hlsdownloads/"
-
-		// Функция для рекурсивного обхода файлов
-		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				// Обработка ошибки, например, запись в лог
-				return nil
-			}
-
-			if info.IsDir() {
-				entries, err := os.ReadDir(path)
-				if err != nil {
-					// Обработка ошибки, например, запись в лог
-					log.Println("Failed to read directory:", err)
-					return nil
-				}
-
-				// Фильтрация скрытых файлов
-				visibleEntries := 0
-				for _, entry := range entries {
-					if !strings.HasPrefix(entry.Name(), ".") {
-						visibleEntries++
-					}
-				}
-
-				if visibleEntries == 0 && time.Since(info.ModTime()) > 5*time.Minute {
-					if err := os.RemoveAll(path); err != nil {
-						// Обработка ошибки, например, запись в лог
-						log.Println("Failed to remove empty directory:", err)
-					}
-				}
-			} else if (filepath.Ext(path) == ".ts" || filepath.Ext(path) == ".m3u8") && time.Since(info.ModTime()) > 5*time.Minute {
-				_ = os.Remove(path)
-			}
-			return nil
-		})
-
-		if err != nil {
-			log.Println("Failed:", err)
-		}
-	}
-}
@@ -10,7 +10,11 @@ require (
 	github.com/tellytv/go.xtream-codes v0.0.0-20220204001149-59925bc76764
 )
 
-require github.com/grafov/m3u8 v0.12.0
+require (
+	github.com/grafov/m3u8 v0.12.0
+	github.com/oschwald/maxminddb-golang v1.12.0
+	golang.org/x/crypto v0.15.0
+)
 
 require (
 	github.com/bytedance/sonic v1.10.2 // indirect
@@ -46,7 +50,6 @@ require (
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/arch v0.6.0 // indirect
-	golang.org/x/crypto v0.15.0 // indirect
 	golang.org/x/exp v0.0.0-20231110203233-9a3e6036ecaa // indirect
 	golang.org/x/net v0.18.0 // indirect
 	golang.org/x/sys v0.14.0 // indirect
@@ -0,0 +1,132 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package access decides which client addresses may reach the proxy,
+// from CIDR lists and from their country in a MaxMind database.
+package access
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Rules are allow and deny lists of networks and countries. Denials win,
+// then the allowed networks, which also escape the country rules.
+type Rules struct {
+	allow, deny                   []netip.Prefix
+	allowCountries, denyCountries map[string]bool
+}
+
+// New returns the rules of CIDR ("192.168.0.0/16") or IP lists and
+// ISO country codes lists, nil when they are all empty.
+func New(allow, deny, allowCountries, denyCountries []string) (*Rules, error) {
+	if len(allow)+len(deny)+len(allowCountries)+len(denyCountries) == 0 {
+		return nil, nil
+	}
+
+	r := &Rules{
+		allowCountries: countries(allowCountries),
+		denyCountries:  countries(denyCountries),
+	}
+	var err error
+	if r.allow, err = prefixes(allow); err != nil {
+		return nil, err
+	}
+	if r.deny, err = prefixes(deny); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func prefixes(list []string) ([]netip.Prefix, error) {
+	var ret []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("access: invalid network %q", s)
+			}
+			ret = append(ret, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("access: invalid network %q", s)
+		}
+		ret = append(ret, p.Masked())
+	}
+
+	return ret, nil
+}
+
+func countries(list []string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, c := range list {
+		ret[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+
+	return ret
+}
+
+// HasCountries returns true if the rules need the client countries.
+func (r *Rules) HasCountries() bool {
+	return len(r.allowCountries) > 0 || len(r.denyCountries) > 0
+}
+
+// Allows returns true if the rules allow an address. country returns
+// its ISO code, "" if unknown; it is only called for public addresses.
+func (r *Rules) Allows(ip netip.Addr, country func(netip.Addr) string) bool {
+	ip = ip.Unmap()
+	if contains(r.deny, ip) {
+		return false
+	}
+	if contains(r.allow, ip) {
+		return true
+	}
+
+	// the local networks aren't in the countries databases
+	if r.HasCountries() && Public(ip) {
+		code := country(ip)
+		if r.denyCountries[code] {
+			return false
+		}
+		if len(r.allowCountries) > 0 {
+			return r.allowCountries[code]
+		}
+	}
+
+	return len(r.allow) == 0
+}
+
+// Public returns false for the loopback, private and link-local addresses.
+func Public(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func contains(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
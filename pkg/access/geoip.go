@@ -0,0 +1,67 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package access
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP is a MaxMind format countries database (GeoLite2-Country,
+// GeoIP2-Country or City, DB-IP...).
+type GeoIP struct {
+	db *maxminddb.Reader
+}
+
+// OpenGeoIP opens a database file.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GeoIP{db: db}, nil
+}
+
+// Country returns the ISO code of the country of an address, "" if unknown.
+func (g *GeoIP) Country(ip netip.Addr) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := g.db.Lookup(net.IP(ip.AsSlice()), &record); err != nil {
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+
+	return record.RegisteredCountry.ISOCode
+}
+
+// Close closes the database.
+func (g *GeoIP) Close() error {
+	return g.db.Close()
+}
@@ -20,6 +20,9 @@ package config
 
 import (
 	"net/url"
+	"regexp"
+
+	"github.com/buga1234/iptv-proxy/pkg/filter"
 )
 
 // CredentialString represents an iptv-proxy credential.
@@ -41,6 +44,18 @@ type HostConfiguration struct {
 	Port     int
 }
 
+// XtreamM3uContent selects a kind of xtream streams in the m3u generated from the API
+type XtreamM3uContent struct {
+	Enabled bool
+	// categories to include, matched on their name, all of them when nil
+	Categories *regexp.Regexp
+}
+
+// Include returns true if the streams of the category are included.
+func (c XtreamM3uContent) Include(category string) bool {
+	return c.Enabled && (c.Categories == nil || c.Categories.MatchString(category))
+}
+
 // ProxyConfig Contain original m3u playlist and HostConfiguration
 type ProxyConfig struct {
 	HostConfig           *HostConfiguration
@@ -48,7 +63,14 @@ type ProxyConfig struct {
 	XtreamPassword       CredentialString
 	XtreamBaseURL        string
 	XtreamGenerateApiGet bool
+	XtreamM3uLive        XtreamM3uContent
+	XtreamM3uVOD         XtreamM3uContent
+	XtreamM3uSeries      XtreamM3uContent
+	XtreamEmulation      bool
 	M3UCacheExpiration   int
+	EPGCacheExpiration   int
+	EPGSources           []string
+	CatchupTimezone      string
 	M3UFileName          string
 	CustomEndpoint       string
 	CustomId             string
@@ -56,4 +78,47 @@ type ProxyConfig struct {
 	AdvertisedPort       int
 	HTTPS                bool
 	User, Password       CredentialString
+	Users                *UserStore
+	StreamLimit          int
+	HDHomeRun            bool
+	HDHomeRunDeviceID    string
+	HDHomeRunSSDP        bool
+	Stalker              bool
+	Filter               *filter.Filter
+	ImageProxy           bool
+	ImageCacheDir        string
+	ImageCacheSize       int // MB, 0 for no limit
+	ImageSize            int // pixels, 0 keeps the original size
+	VODCache             bool
+	VODCacheDir          string
+	VODCacheSize         int // GB, 0 for no limit
+	DVR                  bool
+	DVRDir               string
+	DVRFormat            string
+	DVRPadding           int // minutes
+	Timeshift            int // minutes, 0 to disable
+	WorkDir              string
+	WorkDirQuota         int // MB, 0 for no limit
+	WorkIdleTimeout      int // minutes
+	SignedURLs           bool
+	SignedURLsTTL        int // hours
+	SignedURLsIP         bool
+	AuthMaxFailures      int // 0 to disable the lockout
+	AuthLockout          int // minutes
+	AuthLockoutMax       int // minutes
+	RateLimit            int // requests per minute, 0 for no limit
+	RateLimitBurst       int
+	Metrics              bool
+	Allow                []string
+	Deny                 []string
+	AllowCountries       []string
+	DenyCountries        []string
+	GeoIPDatabase        string
+	TrustedProxies       []string
+	TLSCert              string
+	TLSKey               string
+	TLSClientCA          string
+	TLSRequireClientCert bool
+	HTTPRedirectPort     int
+	ShutdownTimeout      int // seconds
 }
@@ -0,0 +1,125 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords may be bcrypt hashes ("$2a$", "$2b$", "$2y$") or argon2id
+// hashes in the PHC format ("$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>").
+
+// argon2id parameters of the new hashes
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// IsPasswordHash returns true if the password is a bcrypt or argon2id hash.
+func IsPasswordHash(password string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(password, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HashPassword hashes a password with "bcrypt" or "argon2id".
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case "argon2id":
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
+// PasswordSecret returns the secret standing for a hashed password in
+// the proxy URLs, stable as long as the hash.
+func PasswordSecret(hash string) string {
+	sum := sha256.Sum256([]byte("iptv-proxy url\n" + hash))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// checkPassword compares a password to a stored one, hashed or not,
+// in constant time.
+func checkPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return checkArgon2(stored, password)
+	case IsPasswordHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+func checkArgon2(hash, password string) bool {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
@@ -0,0 +1,183 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// UserAccount is an iptv-proxy user.
+type UserAccount struct {
+	Username CredentialString `mapstructure:"username"`
+	Password CredentialString `mapstructure:"password"`
+	// MAC addresses of the user Stalker (MAG) set-top boxes
+	MACs []string `mapstructure:"macs"`
+	// regexps of the xtream categories hidden to the user
+	HiddenCategories []string `mapstructure:"hidden-categories"`
+	// signs the user stream URLs, changing it revokes them (by default, the password)
+	URLKey CredentialString `mapstructure:"url-key"`
+	// networks (CIDR or IP) and countries (ISO codes) the user may connect from
+	Allow          []string `mapstructure:"allow"`
+	Deny           []string `mapstructure:"deny"`
+	AllowCountries []string `mapstructure:"allow-countries"`
+	DenyCountries  []string `mapstructure:"deny-countries"`
+
+	hidden []*regexp.Regexp
+}
+
+// Hides returns true if the category is hidden to the user.
+func (u *UserAccount) Hides(category string) bool {
+	if u == nil {
+		return false
+	}
+	for _, re := range u.hidden {
+		if re.MatchString(category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SigningKey returns the key of the user signed stream URLs.
+func (u *UserAccount) SigningKey() string {
+	if u.URLKey != "" {
+		return u.URLKey.String()
+	}
+
+	return u.Password.String()
+}
+
+// URLPassword returns the password of the user in the proxy URLs, the
+// secret standing for it when it is hashed.
+func (u *UserAccount) URLPassword() string {
+	if IsPasswordHash(u.Password.String()) {
+		return PasswordSecret(u.Password.String())
+	}
+
+	return u.Password.String()
+}
+
+// UserStore holds the iptv-proxy users.
+type UserStore struct {
+	users []UserAccount
+
+	// credentials already checked, hashing them on each request is slow
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]int
+}
+
+// NewUserStore returns a store of the given users, the first one being the main user.
+func NewUserStore(users ...UserAccount) *UserStore {
+	s := &UserStore{verified: make(map[[sha256.Size]byte]int)}
+	for _, u := range users {
+		if u.Username == "" {
+			continue
+		}
+		u.MACs = append([]string(nil), u.MACs...)
+		for i, mac := range u.MACs {
+			u.MACs[i] = NormalizeMAC(mac)
+		}
+		u.hidden = nil
+		for _, expr := range u.HiddenCategories {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				// not a regexp, hide that category only
+				re = regexp.MustCompile("^" + regexp.QuoteMeta(expr) + "$")
+			}
+			u.hidden = append(u.hidden, re)
+		}
+		s.users = append(s.users, u)
+	}
+
+	return s
+}
+
+// Users returns all the users.
+func (s *UserStore) Users() []UserAccount {
+	return s.users
+}
+
+// Authenticate returns the user matching the credentials, the passwords
+// being compared in constant time.
+func (s *UserStore) Authenticate(username, password string) (*UserAccount, bool) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	s.mu.Lock()
+	i, ok := s.verified[key]
+	s.mu.Unlock()
+	if ok {
+		return &s.users[i], true
+	}
+
+	for i := range s.users {
+		u := &s.users[i]
+		if subtle.ConstantTimeCompare([]byte(u.Username), []byte(username)) == 1 && checkPassword(u.Password.String(), password) {
+			s.mu.Lock()
+			s.verified[key] = i
+			s.mu.Unlock()
+			return u, true
+		}
+	}
+
+	return nil, false
+}
+
+// User returns the user with that username.
+func (s *UserStore) User(username string) (*UserAccount, bool) {
+	for i := range s.users {
+		if s.users[i].Username.String() == username {
+			return &s.users[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// ByMAC returns the user owning a set-top box.
+func (s *UserStore) ByMAC(mac string) (*UserAccount, bool) {
+	mac = NormalizeMAC(mac)
+	if mac == "" {
+		return nil, false
+	}
+
+	for i := range s.users {
+		for _, m := range s.users[i].MACs {
+			if m == mac {
+				return &s.users[i], true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// NormalizeMAC returns a MAC address in the "00:1A:79:XX:XX:XX" form, or "" if invalid.
+func NormalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToUpper(hw.String())
+}
@@ -0,0 +1,506 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package dvr records live channels to disk, on schedules.
+package dvr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/epg"
+	"github.com/buga1234/iptv-proxy/pkg/procgroup"
+)
+
+// OpenFunc opens the live stream of a channel.
+// It returns ErrBusy when the provider connection limit is reached.
+type OpenFunc func(ctx context.Context, channel string) (io.ReadCloser, error)
+
+// GuideFunc returns the programmes of a channel not finished at from.
+type GuideFunc func(ctx context.Context, channel string, from time.Time) []epg.Listing
+
+// ErrBusy is returned by OpenFunc when no stream is available,
+// the recording waits for one.
+var ErrBusy = errors.New("stream limit reached")
+
+// Recording statuses.
+const (
+	StatusWaiting   = "waiting" // for a stream
+	StatusRecording = "recording"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Recording is a recorded, or being recorded, programme.
+type Recording struct {
+	ID          int       `json:"id"`
+	Schedule    int       `json:"schedule"`
+	Channel     string    `json:"channel"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Start       time.Time `json:"start"`
+	Stop        time.Time `json:"stop"`
+	File        string    `json:"file"`
+	Size        int64     `json:"size"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Duration is the recording length.
+func (r *Recording) Duration() time.Duration {
+	return r.Stop.Sub(r.Start)
+}
+
+const stateFile = "dvr.json"
+
+// how often the schedules are checked
+const planInterval = 30 * time.Second
+
+// delay between stream attempts
+const retryDelay = 10 * time.Second
+
+type state struct {
+	NextID     int         `json:"next_id"`
+	Schedules  []Schedule  `json:"schedules"`
+	Recordings []Recording `json:"recordings"`
+}
+
+// DVR plans and runs the recordings.
+type DVR struct {
+	dir     string
+	format  string
+	padding time.Duration
+	open    OpenFunc
+	guide   GuideFunc
+
+	lock  sync.Mutex
+	state state
+	// running recordings by occurrence key
+	active map[string]context.CancelFunc
+	// occurrences of the removed running recordings, not to start again
+	// until their end
+	removed map[string]time.Time
+
+	// plans again when a schedule is added
+	wake chan struct{}
+	// the running recordings, finalised before Run returns
+	recording sync.WaitGroup
+}
+
+// New returns a DVR storing its recordings in dir, as MPEG-TS or, with
+// format "mp4", remuxed to MP4 by ffmpeg once done. Recordings start
+// padding before and stop padding after the programmes.
+func New(dir, format string, padding time.Duration, open OpenFunc, guide GuideFunc) (*DVR, error) {
+	if format != "ts" && format != "mp4" {
+		return nil, fmt.Errorf("invalid recording format %q", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &DVR{
+		dir:     dir,
+		format:  format,
+		padding: padding,
+		open:    open,
+		guide:   guide,
+		active:  map[string]context.CancelFunc{},
+		removed: map[string]time.Time{},
+		wake:    make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &d.state); err != nil {
+			return nil, fmt.Errorf("%s: %v", stateFile, err)
+		}
+	}
+
+	// interrupted by a restart
+	for i := range d.state.Recordings {
+		r := &d.state.Recordings[i]
+		if r.Status == StatusRecording || r.Status == StatusWaiting {
+			r.Status = StatusFailed
+			r.Error = "interrupted"
+			if info, err := os.Stat(d.Path(r)); err == nil && info.Size() > 0 {
+				r.Size = info.Size()
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// saveLocked writes the state, with lock held.
+func (d *DVR) saveLocked() {
+	data, err := json.MarshalIndent(d.state, "", "  ")
+	if err == nil {
+		tmp := filepath.Join(d.dir, "."+stateFile)
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, filepath.Join(d.dir, stateFile))
+		}
+	}
+	if err != nil {
+		log.Printf("[iptv-proxy] %v | DVR: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+	}
+}
+
+func (d *DVR) nextIDLocked() int {
+	d.state.NextID++
+	return d.state.NextID
+}
+
+// Path returns the file of a recording.
+func (d *DVR) Path(r *Recording) string {
+	return filepath.Join(d.dir, r.File)
+}
+
+// Schedules returns the schedules.
+func (d *DVR) Schedules() []Schedule {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]Schedule{}, d.state.Schedules...)
+}
+
+// AddSchedule validates and adds a schedule, it returns it with its id.
+func (d *DVR) AddSchedule(s Schedule) (Schedule, error) {
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+
+	d.lock.Lock()
+	s.ID = d.nextIDLocked()
+	d.state.Schedules = append(d.state.Schedules, s)
+	d.saveLocked()
+	d.lock.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+
+	return s, nil
+}
+
+// RemoveSchedule removes a schedule, its running recordings are kept.
+func (d *DVR) RemoveSchedule(id int) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, s := range d.state.Schedules {
+		if s.ID == id {
+			d.state.Schedules = append(d.state.Schedules[:i], d.state.Schedules[i+1:]...)
+			d.saveLocked()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Recordings returns the recordings, the most recent first.
+func (d *DVR) Recordings() []Recording {
+	d.lock.Lock()
+	recordings := append([]Recording{}, d.state.Recordings...)
+	d.lock.Unlock()
+
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].Start.After(recordings[j].Start)
+	})
+
+	return recordings
+}
+
+// Recording returns a recording by id.
+func (d *DVR) Recording(id int) (Recording, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, r := range d.state.Recordings {
+		if r.ID == id {
+			return r, true
+		}
+	}
+
+	return Recording{}, false
+}
+
+// RemoveRecording stops a recording if running and deletes it.
+func (d *DVR) RemoveRecording(id int) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, r := range d.state.Recordings {
+		if r.ID != id {
+			continue
+		}
+		if cancel := d.active[r.key()]; cancel != nil {
+			cancel()
+			d.removed[r.key()] = r.Stop.Add(d.padding)
+		}
+		_ = os.Remove(d.Path(&r))
+		d.state.Recordings = append(d.state.Recordings[:i], d.state.Recordings[i+1:]...)
+		d.saveLocked()
+		return true
+	}
+
+	return false
+}
+
+func (r *Recording) key() string {
+	return occurrence{schedule: r.Schedule, start: r.Start}.key()
+}
+
+func (d *DVR) update(id int, update func(r *Recording)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i := range d.state.Recordings {
+		if d.state.Recordings[i].ID == id {
+			update(&d.state.Recordings[i])
+			d.saveLocked()
+			return
+		}
+	}
+}
+
+// Run checks the schedules until ctx is done, then stops the running
+// recordings and waits for them to be finalised.
+func (d *DVR) Run(ctx context.Context) {
+	ticker := time.NewTicker(planInterval)
+	defer ticker.Stop()
+
+	d.plan(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			d.recording.Wait()
+			return
+		case <-ticker.C:
+			d.plan(ctx)
+		case <-d.wake:
+			d.plan(ctx)
+		}
+	}
+}
+
+// plan starts the recordings due and drops the finished one-off schedules.
+func (d *DVR) plan(ctx context.Context) {
+	now := time.Now()
+	from, to := now.Add(-d.padding), now.Add(d.padding+planInterval)
+
+	var due []occurrence
+	for _, s := range d.Schedules() {
+		for _, o := range s.occurrences(ctx, from, to, d.guide) {
+			if !now.Before(o.start.Add(-d.padding)) && now.Before(o.stop.Add(d.padding)) {
+				due = append(due, o)
+			}
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	schedules := d.state.Schedules[:0]
+	for _, s := range d.state.Schedules {
+		if !s.expired(now, d.padding) {
+			schedules = append(schedules, s)
+		}
+	}
+	changed := len(schedules) != len(d.state.Schedules)
+	d.state.Schedules = schedules
+
+	for key, end := range d.removed {
+		if now.After(end) {
+			delete(d.removed, key)
+		}
+	}
+
+	for _, o := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := d.active[o.key()]; ok || d.recordedLocked(o) {
+			continue
+		}
+		if _, ok := d.removed[o.key()]; ok {
+			continue
+		}
+
+		r := Recording{
+			ID:          d.nextIDLocked(),
+			Schedule:    o.schedule,
+			Channel:     o.channel,
+			Title:       o.title,
+			Description: o.description,
+			Start:       o.start,
+			Stop:        o.stop,
+			Status:      StatusWaiting,
+		}
+		r.File = fmt.Sprintf("%d.ts", r.ID)
+		d.state.Recordings = append(d.state.Recordings, r)
+		changed = true
+
+		rctx, cancel := context.WithDeadline(ctx, o.stop.Add(d.padding))
+		d.active[o.key()] = cancel
+		d.recording.Add(1)
+		go d.record(rctx, r)
+	}
+
+	if changed {
+		d.saveLocked()
+	}
+}
+
+// recordedLocked reports whether an occurrence already has a recording,
+// e.g. before a restart. The recordings interrupted by the shutdown are
+// completed with their error, the rest of the occurrence is recorded again.
+func (d *DVR) recordedLocked(o occurrence) bool {
+	for _, r := range d.state.Recordings {
+		if r.key() == o.key() && r.Status == StatusCompleted && r.Error == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// record writes the channel stream until ctx is done, reconnecting when
+// the stream drops or waiting when no stream is available.
+func (d *DVR) record(ctx context.Context, r Recording) {
+	defer d.recording.Done()
+	key := r.key()
+	defer func() {
+		d.lock.Lock()
+		if cancel := d.active[key]; cancel != nil {
+			cancel()
+		}
+		delete(d.active, key)
+		d.lock.Unlock()
+	}()
+
+	log.Printf("[iptv-proxy] %v | DVR: recording %q on %q\n", time.Now().Format("2006/01/02 - 15:04:05"), r.Title, r.Channel)
+
+	f, err := os.Create(d.Path(&r))
+	if err != nil {
+		d.update(r.ID, func(r *Recording) { r.Status, r.Error = StatusFailed, err.Error() })
+		return
+	}
+
+	var size int64
+	var lastErr error
+	for ctx.Err() == nil {
+		stream, err := d.open(ctx, r.Channel)
+		if err == nil {
+			d.update(r.ID, func(r *Recording) { r.Status, r.Error = StatusRecording, "" })
+			n, cerr := io.Copy(f, stream)
+			_ = stream.Close()
+			size += n
+			err = cerr
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+		} else if errors.Is(err, ErrBusy) {
+			d.update(r.ID, func(r *Recording) { r.Status, r.Error = StatusWaiting, err.Error() })
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		lastErr = err
+		log.Printf("[iptv-proxy] %v | DVR: %q: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), r.Title, err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+	}
+	_ = f.Close()
+	// cancelled before its end by the shutdown, not by its deadline
+	var interrupted string
+	if errors.Is(ctx.Err(), context.Canceled) {
+		interrupted = "interrupted"
+	}
+
+	// removed meanwhile
+	if _, ok := d.Recording(r.ID); !ok {
+		_ = os.Remove(d.Path(&r))
+		return
+	}
+
+	if size == 0 {
+		msg := "no data"
+		if lastErr != nil {
+			msg = lastErr.Error()
+		}
+		d.update(r.ID, func(r *Recording) { r.Status, r.Error = StatusFailed, msg })
+		return
+	}
+
+	file := r.File
+	if d.format == "mp4" {
+		if mp4, err := d.remux(&r); err != nil {
+			log.Printf("[iptv-proxy] %v | DVR: %q: mp4: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), r.Title, err)
+		} else {
+			file = mp4
+			if info, err := os.Stat(filepath.Join(d.dir, mp4)); err == nil {
+				size = info.Size()
+			}
+		}
+	}
+
+	d.update(r.ID, func(r *Recording) {
+		r.Status, r.Error, r.File, r.Size = StatusCompleted, interrupted, file, size
+	})
+	log.Printf("[iptv-proxy] %v | DVR: recorded %q\n", time.Now().Format("2006/01/02 - 15:04:05"), r.Title)
+}
+
+// remux converts the MPEG-TS recording to MP4 without transcoding,
+// the TS file is kept if it fails.
+func (d *DVR) remux(r *Recording) (string, error) {
+	file := fmt.Sprintf("%d.mp4", r.ID)
+	out := filepath.Join(d.dir, file)
+
+	var output bytes.Buffer
+	cmd := procgroup.Command(context.Background(), "ffmpeg", "-y", "-loglevel", "error", "-i", d.Path(r), "-c", "copy", "-movflags", "+faststart", out)
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := procgroup.Start(cmd)
+	if err == nil {
+		err = procgroup.Wait(cmd)
+	}
+	if err != nil {
+		_ = os.Remove(out)
+		return "", fmt.Errorf("%v: %s", err, output.Bytes())
+	}
+	_ = os.Remove(d.Path(r))
+
+	return file, nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dvr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Schedule is a recording rule of a channel, one of:
+//   - one-off: Start and Stop,
+//   - recurring: Days, Time and Duration,
+//   - guide match: Title, every programme of the channel matching it.
+type Schedule struct {
+	ID      int    `json:"id"`
+	Channel string `json:"channel"`
+	// recordings title, the programme title by default
+	Name string `json:"name,omitempty"`
+
+	Start *time.Time `json:"start,omitempty"`
+	Stop  *time.Time `json:"stop,omitempty"`
+
+	// week days ("mon", "tue"...), every day when empty
+	Days []string `json:"days,omitempty"`
+	// local time, "20:30"
+	Time     string `json:"time,omitempty"`
+	Duration int    `json:"duration,omitempty"` // minutes
+
+	// regexp of the programme titles
+	Title string `json:"title,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// occurrence is a programme to record.
+type occurrence struct {
+	schedule    int
+	channel     string
+	start, stop time.Time
+	title       string
+	description string
+}
+
+// key identifies an occurrence, it is recorded once.
+func (o occurrence) key() string {
+	return fmt.Sprintf("%d-%d", o.schedule, o.start.Unix())
+}
+
+func (s *Schedule) oneOff() bool {
+	return s.Start != nil
+}
+
+func (s *Schedule) recurring() bool {
+	return s.Time != ""
+}
+
+// validate checks the schedule is of one kind only and well formed.
+func (s *Schedule) validate() error {
+	if strings.TrimSpace(s.Channel) == "" {
+		return errors.New("missing channel")
+	}
+
+	kinds := 0
+	if s.Stop != nil && s.Start == nil {
+		return errors.New("missing start")
+	}
+	if s.oneOff() {
+		kinds++
+		if s.Stop == nil || !s.Stop.After(*s.Start) {
+			return errors.New("stop must be after start")
+		}
+	}
+	if s.recurring() {
+		kinds++
+		if _, err := time.Parse("15:04", s.Time); err != nil {
+			return fmt.Errorf("invalid time %q", s.Time)
+		}
+		if s.Duration <= 0 {
+			return errors.New("missing duration")
+		}
+		for _, day := range s.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("invalid day %q", day)
+			}
+		}
+	}
+	if s.Title != "" {
+		kinds++
+		if _, err := regexp.Compile(s.Title); err != nil {
+			return fmt.Errorf("invalid title: %v", err)
+		}
+	}
+	if kinds != 1 {
+		return errors.New("a schedule needs start and stop, time and duration, or title")
+	}
+
+	return nil
+}
+
+// expired reports whether a one-off schedule is over.
+func (s *Schedule) expired(now time.Time, padding time.Duration) bool {
+	return s.oneOff() && now.After(s.Stop.Add(padding))
+}
+
+// occurrences returns the programmes of the schedule overlapping [from, to).
+func (s *Schedule) occurrences(ctx context.Context, from, to time.Time, guide GuideFunc) []occurrence {
+	var ret []occurrence
+	add := func(start, stop time.Time, title, description string) {
+		if start.Before(to) && stop.After(from) {
+			if s.Name != "" {
+				title = s.Name
+			}
+			ret = append(ret, occurrence{schedule: s.ID, channel: s.Channel, start: start, stop: stop, title: title, description: description})
+		}
+	}
+
+	switch {
+	case s.oneOff():
+		add(*s.Start, *s.Stop, s.Channel, "")
+
+	case s.recurring():
+		at, _ := time.Parse("15:04", s.Time)
+		// yesterday's occurrence may still be running
+		for day := from.AddDate(0, 0, -1); !day.After(to); day = day.AddDate(0, 0, 1) {
+			if !s.on(day.Weekday()) {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, time.Local)
+			add(start, start.Add(time.Duration(s.Duration)*time.Minute), s.Channel, "")
+		}
+
+	case s.Title != "" && guide != nil:
+		re, err := regexp.Compile(s.Title)
+		if err != nil {
+			return nil
+		}
+		for _, l := range guide(ctx, s.Channel, from) {
+			if !l.Start.Before(to) {
+				break
+			}
+			if re.MatchString(l.Title) {
+				add(l.Start, l.Stop, l.Title, l.Description)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (s *Schedule) on(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+
+	return false
+}
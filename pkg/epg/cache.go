@@ -0,0 +1,314 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// FetchFunc opens the upstream XMLTV guide.
+type FetchFunc func(ctx context.Context) (io.ReadCloser, error)
+
+// LineupFunc returns the channels the guide is trimmed to.
+type LineupFunc func(ctx context.Context) (*Lineup, error)
+
+// File is a snapshot of the cached guide.
+type File struct {
+	Path     string
+	GzipPath string
+	ETag     string
+	ModTime  time.Time
+}
+
+// Cache keeps a filtered copy of XMLTV guides on disk, merged,
+// plain and gzip-compressed, and refreshes it periodically.
+type Cache struct {
+	sources    []FetchFunc
+	lineup     LineupFunc
+	expiration time.Duration
+
+	lock    sync.RWMutex
+	current *File
+	index   *index
+
+	// serialize refreshes
+	refreshLock sync.Mutex
+}
+
+// NewCache returns a new guide cache refreshed every expiration.
+// Sources are merged in order, the first one providing a channel wins.
+func NewCache(sources []FetchFunc, lineup LineupFunc, expiration time.Duration) *Cache {
+	return &Cache{
+		sources:    sources,
+		lineup:     lineup,
+		expiration: expiration,
+	}
+}
+
+// Get returns the cached guide, fetching it first if needed.
+func (c *Cache) Get(ctx context.Context) (File, error) {
+	c.lock.RLock()
+	f := c.current
+	c.lock.RUnlock()
+	if f != nil {
+		return *f, nil
+	}
+
+	if err := c.Refresh(ctx); err != nil {
+		return File{}, err
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return *c.current, nil
+}
+
+// Open opens the cached guide, gzip-compressed or not, fetching it first
+// if needed. It is opened before a refresh may remove it.
+func (c *Cache) Open(ctx context.Context, gz bool) (*os.File, File, error) {
+	if _, err := c.Get(ctx); err != nil {
+		return nil, File{}, err
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.current == nil {
+		return nil, File{}, fmt.Errorf("no EPG cached")
+	}
+	f := *c.current
+	path := f.Path
+	if gz {
+		path = f.GzipPath
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, File{}, err
+	}
+
+	return file, f, nil
+}
+
+// Refresh downloads, merges, filters and stores the guides.
+func (c *Cache) Refresh(ctx context.Context) error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	c.lock.RLock()
+	fresh := c.current != nil && time.Since(c.current.ModTime) < c.expiration/2
+	c.lock.RUnlock()
+	// Concurrent callers waiting on the refresh lock don't need another download.
+	if fresh {
+		return nil
+	}
+
+	var lineup *Lineup
+	if c.lineup != nil {
+		var err error
+		lineup, err = c.lineup(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	base := filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.xml")
+	f := &File{Path: base, GzipPath: base + ".gz", ModTime: time.Now()}
+
+	idx := newIndex()
+	stats, etag, err := c.writeFiles(ctx, f, lineup, idx)
+	if err != nil {
+		removeFiles(f)
+		return err
+	}
+	f.ETag = etag
+	idx.sort()
+
+	c.lock.Lock()
+	old := c.current
+	c.current = f
+	c.index = idx
+	c.lock.Unlock()
+
+	// Files being served stay readable until closed.
+	if old != nil {
+		removeFiles(old)
+	}
+
+	log.Printf("[iptv-proxy] %v | EPG cache refreshed: %d channels, %d programmes\n", time.Now().Format("2006/01/02 - 15:04:05"), stats.Channels, stats.Programmes)
+
+	return nil
+}
+
+func (c *Cache) writeFiles(ctx context.Context, f *File, lineup *Lineup, idx *index) (Stats, string, error) {
+	plain, err := os.Create(f.Path)
+	if err != nil {
+		return Stats{}, "", err
+	}
+	defer func(plain *os.File) {
+		_ = plain.Close()
+	}(plain)
+
+	compressed, err := os.Create(f.GzipPath)
+	if err != nil {
+		return Stats{}, "", err
+	}
+	defer func(compressed *os.File) {
+		_ = compressed.Close()
+	}(compressed)
+
+	gz := gzip.NewWriter(compressed)
+	h := sha256.New()
+	bw := bufio.NewWriter(plain)
+
+	fw := NewWriter(io.MultiWriter(bw, gz, h), lineup)
+	fw.OnChannel = idx.addChannel
+	fw.OnProgramme = idx.add
+	for i, fetch := range c.sources {
+		if err := addSource(ctx, fw, fetch); err != nil {
+			// A broken source must not take the other ones down.
+			log.Printf("[iptv-proxy] %v | EPG source #%d: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), i, err)
+		}
+	}
+	stats := fw.Stats()
+	if err := fw.Close(); err != nil {
+		return stats, "", err
+	}
+	if stats.Channels == 0 {
+		return stats, "", fmt.Errorf("no EPG channel found")
+	}
+	if err := bw.Flush(); err != nil {
+		return stats, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return stats, "", err
+	}
+
+	return stats, `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+func addSource(ctx context.Context, fw *Writer, fetch FetchFunc) error {
+	src, err := fetch(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(src io.ReadCloser) {
+		_ = src.Close()
+	}(src)
+
+	return fw.Add(src)
+}
+
+func removeFiles(f *File) {
+	_ = os.Remove(f.Path)
+	_ = os.Remove(f.GzipPath)
+}
+
+// Close removes the files of the cached guide.
+func (c *Cache) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.current != nil {
+		removeFiles(c.current)
+		c.current = nil
+	}
+}
+
+// Run refreshes the guide until ctx is done.
+func (c *Cache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.expiration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(ctx); err != nil {
+				log.Printf("[iptv-proxy] %v | EPG cache refresh failed: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+			}
+		}
+	}
+}
+
+// Open opens an XMLTV source, either an http(s) URL or a local file.
+// Gzip-compressed sources are transparently decompressed.
+func Open(ctx context.Context, source string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open xmltv URL: %v", err)
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("unable to open xmltv URL: status code %d", resp.StatusCode)
+		}
+		rc = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open xmltv file: %v", err)
+		}
+		rc = file
+	}
+
+	br := bufio.NewReader(rc)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+		return &readCloser{gz, rc}, nil
+	}
+
+	return &readCloser{br, rc}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *readCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,131 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Listing is a programme of the cached guide.
+type Listing struct {
+	Channel     string
+	Start       time.Time
+	Stop        time.Time
+	Title       string
+	Description string
+}
+
+// index holds the cached guide listings by published channel id.
+type index struct {
+	listings map[string][]Listing
+	// normalized channel name -> published channel id
+	names map[string]string
+}
+
+func newIndex() *index {
+	return &index{listings: map[string][]Listing{}, names: map[string]string{}}
+}
+
+func (idx *index) addChannel(ref Ref) {
+	for _, name := range []string{ref.Name, ref.DisplayName} {
+		if key := normalizeName(name); key != "" {
+			idx.names[key] = ref.ID
+		}
+	}
+}
+
+func (idx *index) add(p *Programme) {
+	start, err := ParseTime(p.Start)
+	if err != nil {
+		return
+	}
+	stop, err := ParseTime(p.Stop)
+	if err != nil {
+		stop = start
+	}
+
+	l := Listing{Channel: p.Channel, Start: start, Stop: stop}
+	if len(p.Titles) > 0 {
+		l.Title = strings.TrimSpace(p.Titles[0].Value)
+	}
+	if len(p.Descs) > 0 {
+		l.Description = strings.TrimSpace(p.Descs[0].Value)
+	}
+
+	key := normalizeID(p.Channel)
+	idx.listings[key] = append(idx.listings[key], l)
+}
+
+func (idx *index) sort() {
+	for _, listings := range idx.listings {
+		sort.Slice(listings, func(i, j int) bool {
+			return listings[i].Start.Before(listings[j].Start)
+		})
+	}
+}
+
+// ParseTime parses an XMLTV date, e.g. "20240101203000 +0100".
+func ParseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 14 {
+		return time.Parse("20060102150405 -0700", s)
+	}
+
+	return time.Parse("20060102150405", s)
+}
+
+// ChannelID returns the guide id of a published channel, looked up
+// by EPG id then by name, or "" if the guide doesn't have it.
+func (c *Cache) ChannelID(id, name string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.index == nil {
+		return ""
+	}
+	if _, ok := c.index.listings[normalizeID(id)]; ok && id != "" {
+		return id
+	}
+
+	return c.index.names[normalizeName(name)]
+}
+
+// Listings returns up to limit programmes of a published channel
+// not yet finished at from. A limit <= 0 returns all of them.
+func (c *Cache) Listings(channelID string, from time.Time, limit int) []Listing {
+	c.lock.RLock()
+	var listings []Listing
+	if c.index != nil {
+		listings = c.index.listings[normalizeID(channelID)]
+	}
+	c.lock.RUnlock()
+
+	i := sort.Search(len(listings), func(i int) bool {
+		return listings[i].Stop.After(from)
+	})
+
+	ret := listings[i:]
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+
+	return ret
+}
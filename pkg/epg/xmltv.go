@@ -0,0 +1,429 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package epg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Channel is an XMLTV <channel> element.
+type Channel struct {
+	XMLName      xml.Name `xml:"channel"`
+	ID           string   `xml:"id,attr"`
+	DisplayNames []Text   `xml:"display-name"`
+	Icons        []Icon   `xml:"icon"`
+	URLs         []string `xml:"url"`
+}
+
+// Text is a localized XMLTV text node, e.g. <display-name> or <title>.
+type Text struct {
+	Lang  string `xml:"lang,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// Icon is an XMLTV <icon> element.
+type Icon struct {
+	Src    string `xml:"src,attr"`
+	Width  string `xml:"width,attr,omitempty"`
+	Height string `xml:"height,attr,omitempty"`
+}
+
+// Programme is an XMLTV <programme> element.
+// Only the attributes, titles and descriptions are decoded,
+// the element content is kept verbatim in Inner.
+type Programme struct {
+	Start   string     `xml:"start,attr"`
+	Stop    string     `xml:"stop,attr"`
+	Channel string     `xml:"channel,attr"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Titles  []Text     `xml:"title"`
+	Descs   []Text     `xml:"desc"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// Ref is a channel as published by the proxy.
+type Ref struct {
+	ID string
+	// matched against the guide display names
+	Name string
+	// written first in the display names, "" to keep the guide ones
+	DisplayName string
+}
+
+// Lineup is the set of channels an XMLTV guide is trimmed to.
+// Guide channels are matched by id, then by display name.
+type Lineup struct {
+	byID   map[string]Ref
+	byName map[string]Ref
+}
+
+// NewLineup returns an empty Lineup.
+func NewLineup() *Lineup {
+	return &Lineup{byID: map[string]Ref{}, byName: map[string]Ref{}}
+}
+
+// Add a published channel to the lineup.
+// id is the channel EPG id (tvg-id), it may be empty. The guide channel
+// is matched by name and published under displayName.
+func (l *Lineup) Add(id, name, displayName string) {
+	ref := Ref{ID: id, Name: name, DisplayName: displayName}
+
+	if key := normalizeID(id); key != "" {
+		if _, ok := l.byID[key]; !ok {
+			l.byID[key] = ref
+		}
+	}
+
+	if key := normalizeName(name); key != "" {
+		if _, ok := l.byName[key]; !ok {
+			l.byName[key] = ref
+		}
+	}
+}
+
+// Len returns the number of channels in the lineup.
+func (l *Lineup) Len() int {
+	if l == nil {
+		return 0
+	}
+
+	return len(l.byID) + len(l.byName)
+}
+
+// match returns the published channel for an XMLTV channel.
+// Channels matched by name and published without EPG id keep the guide id.
+func (l *Lineup) match(ch *Channel) (Ref, bool) {
+	if ref, ok := l.byID[normalizeID(ch.ID)]; ok {
+		return ref, true
+	}
+
+	for _, name := range ch.DisplayNames {
+		ref, ok := l.byName[normalizeName(name.Value)]
+		if !ok {
+			continue
+		}
+		if ref.ID == "" {
+			ref.ID = ch.ID
+		}
+		return ref, true
+	}
+
+	return Ref{}, false
+}
+
+func normalizeID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+var (
+	// "FR: ", "UK | ", "|FR| "...
+	namePrefixRegexp = regexp.MustCompile(`^\s*\|?[a-zA-Z]{2,3}\s*[:|]\s*`)
+	// "(backup)", "[FHD]"...
+	nameBracketsRegexp = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+	// quality and codec suffixes
+	nameQualityRegexp = regexp.MustCompile(`(?i)\b(uhd|fhd|hd|sd|4k|hevc|h265|1080p|720p|50fps)\b`)
+)
+
+// normalizeName reduces a channel name to a fuzzy matching key,
+// e.g. "FR: TF1 HD (backup)" and "tf1" give the same key.
+func normalizeName(name string) string {
+	name = namePrefixRegexp.ReplaceAllString(name, "")
+	name = nameBracketsRegexp.ReplaceAllString(name, "")
+	name = nameQualityRegexp.ReplaceAllString(name, "")
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// Stats summarizes a Writer run.
+type Stats struct {
+	Channels   int
+	Programmes int
+}
+
+// Writer merges XMLTV guides into a single one, keeping only the
+// channels of the lineup and their programmes. Channel ids and display
+// names are rewritten to the published ones.
+// An empty lineup keeps the whole guides.
+type Writer struct {
+	// OnChannel and OnProgramme, if set, are called for each
+	// channel and programme written.
+	OnChannel   func(ref Ref)
+	OnProgramme func(p *Programme)
+
+	w       *bufio.Writer
+	lineup  *Lineup
+	keepAll bool
+
+	// published channel ids already written
+	published map[string]bool
+	header    bool
+	stats     Stats
+}
+
+// NewWriter returns a Writer writing the merged guide into w.
+func NewWriter(w io.Writer, lineup *Lineup) *Writer {
+	return &Writer{
+		w:         bufio.NewWriter(w),
+		lineup:    lineup,
+		keepAll:   lineup.Len() == 0,
+		published: map[string]bool{},
+	}
+}
+
+// Filter copies the XMLTV guide read from r into w, trimmed to the lineup.
+func Filter(r io.Reader, w io.Writer, lineup *Lineup) (Stats, error) {
+	fw := NewWriter(w, lineup)
+	if err := fw.Add(r); err != nil {
+		return fw.Stats(), err
+	}
+
+	return fw.Stats(), fw.Close()
+}
+
+// Add merges the XMLTV guide read from r.
+// A channel already published by a previous guide is skipped with its programmes.
+func (fw *Writer) Add(r io.Reader) error {
+	d := newDecoder(r)
+
+	// guide channel id -> published channel
+	kept := map[string]Ref{}
+	inTV := false
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid xmltv: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "tv":
+				if err := fw.writeHeader(t.Attr); err != nil {
+					return err
+				}
+				inTV = true
+			case "channel":
+				var ch Channel
+				if err := d.DecodeElement(&ch, &t); err != nil {
+					return fmt.Errorf("invalid xmltv channel: %v", err)
+				}
+				ref, ok := Ref{ID: ch.ID}, fw.keepAll
+				if !fw.keepAll {
+					ref, ok = fw.lineup.match(&ch)
+				}
+				if !ok || fw.published[ref.ID] {
+					continue
+				}
+				fw.published[ref.ID] = true
+				kept[ch.ID] = ref
+				if err := writeChannel(fw.w, ch, ref); err != nil {
+					return err
+				}
+				if fw.OnChannel != nil {
+					fw.OnChannel(ref)
+				}
+				fw.stats.Channels++
+			case "programme":
+				var p Programme
+				if err := d.DecodeElement(&p, &t); err != nil {
+					return fmt.Errorf("invalid xmltv programme: %v", err)
+				}
+				ref, ok := kept[p.Channel]
+				if !ok {
+					continue
+				}
+				p.Channel = ref.ID
+				if err := p.encode(fw.w); err != nil {
+					return err
+				}
+				if fw.OnProgramme != nil {
+					fw.OnProgramme(&p)
+				}
+				fw.stats.Programmes++
+			default:
+				if inTV {
+					if err := d.Skip(); err != nil {
+						return fmt.Errorf("invalid xmltv: %v", err)
+					}
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "tv" {
+				inTV = false
+			}
+		}
+	}
+}
+
+// Stats returns the number of channels and programmes written so far.
+func (fw *Writer) Stats() Stats {
+	return fw.stats
+}
+
+// Close terminates the merged guide and flushes it.
+func (fw *Writer) Close() error {
+	if err := fw.writeHeader(nil); err != nil {
+		return err
+	}
+	if _, err := fw.w.WriteString("</tv>\n"); err != nil {
+		return err
+	}
+
+	return fw.w.Flush()
+}
+
+// writeHeader writes the guide header once, with the attributes of the first guide.
+func (fw *Writer) writeHeader(attrs []xml.Attr) error {
+	if fw.header {
+		return nil
+	}
+	fw.header = true
+
+	w := fw.w
+	_, _ = w.WriteString(xml.Header)
+	_, _ = w.WriteString(`<!DOCTYPE tv SYSTEM "xmltv.dtd">` + "\n")
+	_, _ = w.WriteString("<tv")
+	for _, a := range attrs {
+		writeAttr(w, a.Name.Local, a.Value)
+	}
+	_, err := w.WriteString(">\n")
+
+	return err
+}
+
+func newDecoder(r io.Reader) *xml.Decoder {
+	d := xml.NewDecoder(r)
+	// Provider guides are often sloppy: undeclared entities,
+	// unescaped ampersands, latin1 content...
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charsetReader
+
+	return d
+}
+
+// charsetReader converts latin1 guides to UTF-8 and lets other charsets through.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+
+	return input, nil
+}
+
+type latin1Reader struct {
+	r *bufio.Reader
+	// the end of a character not fitting in the last read
+	pending []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+
+	var buf [utf8.UTFMax]byte
+	for n < len(p) {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		size := utf8.EncodeRune(buf[:], rune(b))
+		copied := copy(p[n:], buf[:size])
+		n += copied
+		if copied < size {
+			l.pending = append(l.pending[:0], buf[copied:size]...)
+		}
+	}
+
+	return n, nil
+}
+
+func writeAttr(w *bufio.Writer, name, value string) {
+	_, _ = w.WriteString(" " + name + `="`)
+	_ = xml.EscapeText(w, []byte(value))
+	_, _ = w.WriteString(`"`)
+}
+
+func writeChannel(w *bufio.Writer, ch Channel, ref Ref) error {
+	ch.ID = ref.ID
+	if ref.DisplayName != "" {
+		ch.DisplayNames = rename(ch.DisplayNames, ref.DisplayName)
+	}
+
+	b, err := xml.MarshalIndent(ch, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	_, _ = w.Write(b)
+	_, err = w.WriteString("\n")
+
+	return err
+}
+
+// rename puts name first in the display names, keeping the other ones as aliases.
+func rename(names []Text, name string) []Text {
+	ret := make([]Text, 0, len(names)+1)
+	ret = append(ret, Text{Value: name})
+	for _, n := range names {
+		if n.Value == name {
+			continue
+		}
+		ret = append(ret, n)
+	}
+
+	return ret
+}
+
+func (p *Programme) encode(w *bufio.Writer) error {
+	_, _ = w.WriteString("  <programme")
+	writeAttr(w, "start", p.Start)
+	if p.Stop != "" {
+		writeAttr(w, "stop", p.Stop)
+	}
+	writeAttr(w, "channel", p.Channel)
+	for _, a := range p.Attrs {
+		writeAttr(w, a.Name.Local, a.Value)
+	}
+	_, _ = w.WriteString(">")
+	_, _ = w.Write(bytes.TrimSpace(p.Inner))
+	_, err := w.WriteString("</programme>\n")
+
+	return err
+}
@@ -0,0 +1,159 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package filter selects and renames the published channels and categories.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Rename replaces the Match regexp by Replace, which may use $1... submatches.
+type Rename struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+}
+
+// Rules are the filter rules, as read from the config file.
+// Groups are m3u group-titles and xtream categories, names are channel,
+// movie and series names. Exclusions are matched on the original names.
+type Rules struct {
+	// only the groups matching one of these, all of them when empty
+	IncludeGroups []string `mapstructure:"include-groups"`
+	ExcludeGroups []string `mapstructure:"exclude-groups"`
+	ExcludeNames  []string `mapstructure:"exclude-names"`
+	RenameGroups  []Rename `mapstructure:"rename-groups"`
+	RenameNames   []Rename `mapstructure:"rename-names"`
+}
+
+type rename struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// Filter applies Rules, a nil Filter keeps everything unchanged.
+type Filter struct {
+	includeGroups []*regexp.Regexp
+	excludeGroups []*regexp.Regexp
+	excludeNames  []*regexp.Regexp
+	renameGroups  []rename
+	renameNames   []rename
+}
+
+// New compiles the rules, it returns nil when there is none.
+func New(rules Rules) (*Filter, error) {
+	var (
+		f   Filter
+		err error
+	)
+
+	if f.includeGroups, err = compile("include-groups", rules.IncludeGroups); err != nil {
+		return nil, err
+	}
+	if f.excludeGroups, err = compile("exclude-groups", rules.ExcludeGroups); err != nil {
+		return nil, err
+	}
+	if f.excludeNames, err = compile("exclude-names", rules.ExcludeNames); err != nil {
+		return nil, err
+	}
+	if f.renameGroups, err = compileRenames("rename-groups", rules.RenameGroups); err != nil {
+		return nil, err
+	}
+	if f.renameNames, err = compileRenames("rename-names", rules.RenameNames); err != nil {
+		return nil, err
+	}
+
+	if f.includeGroups == nil && f.excludeGroups == nil && f.excludeNames == nil &&
+		f.renameGroups == nil && f.renameNames == nil {
+		return nil, nil
+	}
+
+	return &f, nil
+}
+
+func compile(key string, exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("filters %s: %v", key, err)
+		}
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+func compileRenames(key string, renames []Rename) ([]rename, error) {
+	var res []rename
+	for _, r := range renames {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("filters %s: %v", key, err)
+		}
+		res = append(res, rename{re, r.Replace})
+	}
+
+	return res, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func apply(renames []rename, s string) string {
+	for _, r := range renames {
+		s = r.re.ReplaceAllString(s, r.replace)
+	}
+
+	return s
+}
+
+// Group returns the renamed group, ok is false if the group is excluded.
+func (f *Filter) Group(group string) (renamed string, ok bool) {
+	if f == nil {
+		return group, true
+	}
+	if f.includeGroups != nil && !matchAny(f.includeGroups, group) {
+		return "", false
+	}
+	if matchAny(f.excludeGroups, group) {
+		return "", false
+	}
+
+	return apply(f.renameGroups, group), true
+}
+
+// Name returns the renamed channel name, ok is false if it is excluded.
+func (f *Filter) Name(name string) (renamed string, ok bool) {
+	if f == nil {
+		return name, true
+	}
+	if matchAny(f.excludeNames, name) {
+		return "", false
+	}
+
+	return apply(f.renameNames, name), true
+}
@@ -0,0 +1,301 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package imgcache keeps a disk cache of the channel logos and posters.
+package imgcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxImageSize is the largest image fetched, in bytes.
+const MaxImageSize = 10 << 20
+
+// images are fetched again after maxAge, the cached copy is served
+// if the host is down
+const maxAge = 7 * 24 * time.Hour
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// extensions of the cached files, they give the served Content-Type
+var extensions = map[string]string{
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+	"image/bmp":     ".bmp",
+	"image/x-icon":  ".ico",
+}
+
+type entry struct {
+	path    string
+	size    int64
+	fetched time.Time
+	used    time.Time
+}
+
+type call struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+// Cache stores the images in a directory, the least recently used
+// ones are removed beyond the size limit.
+type Cache struct {
+	dir     string
+	maxSize int64
+	// largest width or height, 0 keeps the original size
+	dimension int
+
+	lock    sync.Mutex
+	entries map[string]*entry
+	total   int64
+	loading map[string]*call
+}
+
+// New returns a cache of at most maxSize bytes (0 for no limit) in dir,
+// resizing the images to fit dimension pixels when it is not 0.
+// Images already in dir are kept.
+func New(dir string, maxSize int64, dimension int) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:       dir,
+		maxSize:   maxSize,
+		dimension: dimension,
+		entries:   map[string]*entry{},
+		loading:   map[string]*call{},
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if strings.HasPrefix(name, ".") {
+			// interrupted download
+			_ = os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(name, filepath.Ext(name))
+		c.entries[key] = &entry{path: path, size: info.Size(), fetched: info.ModTime(), used: info.ModTime()}
+		c.total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.evictLocked("")
+
+	return c, nil
+}
+
+// key identifies an image and its rendering.
+func (c *Cache) key(src string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(c.dimension) + " " + src))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the path of the cached image of src, fetching it when needed.
+func (c *Cache) Get(ctx context.Context, src string) (string, error) {
+	key := c.key(src)
+
+	c.lock.Lock()
+	e := c.entries[key]
+	if e != nil {
+		e.used = time.Now()
+		if time.Since(e.fetched) < maxAge {
+			path := e.path
+			c.lock.Unlock()
+			return path, nil
+		}
+	}
+
+	cl := c.loading[key]
+	if cl == nil {
+		cl = &call{done: make(chan struct{})}
+		c.loading[key] = cl
+		// not bound to the request, other players may wait for it
+		go c.fetch(key, src, cl)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-cl.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if cl.err != nil && e != nil {
+		// expired, but better than nothing
+		return e.path, nil
+	}
+
+	return cl.path, cl.err
+}
+
+func (c *Cache) fetch(key, src string, cl *call) {
+	defer func() {
+		c.lock.Lock()
+		delete(c.loading, key)
+		c.lock.Unlock()
+		close(cl.done)
+	}()
+
+	data, contentType, err := download(src)
+	if err == nil && c.dimension > 0 {
+		data, contentType = resize(data, contentType, c.dimension)
+	}
+	if err == nil {
+		cl.path, err = c.store(key, data, contentType)
+	}
+	if err != nil {
+		log.Printf("[iptv-proxy] %v | image %s: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), src, err)
+	}
+	cl.err = err
+}
+
+func download(src string) ([]byte, string, error) {
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s", resp.Status)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("not an image: %q", contentType)
+	}
+	if resp.ContentLength > MaxImageSize {
+		return nil, "", fmt.Errorf("too large: %d bytes", resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxImageSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > MaxImageSize {
+		return nil, "", fmt.Errorf("larger than %d bytes", MaxImageSize)
+	}
+
+	return data, contentType, nil
+}
+
+// store writes the image and removes the previous version.
+func (c *Cache) store(key string, data []byte, contentType string) (string, error) {
+	ext, ok := extensions[contentType]
+	if !ok {
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+
+	dir := filepath.Join(c.dir, key[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "."+key)
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	path := filepath.Join(dir, key+ext)
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old := c.entries[key]; old != nil {
+		c.total -= old.size
+		if old.path != path {
+			_ = os.Remove(old.path)
+		}
+	}
+	c.entries[key] = &entry{path: path, size: int64(len(data)), fetched: now, used: now}
+	c.total += int64(len(data))
+	c.evictLocked(key)
+
+	return path, nil
+}
+
+// evictLocked removes the least recently used images beyond the size limit,
+// except keep.
+func (c *Cache) evictLocked(keep string) {
+	if c.maxSize <= 0 || c.total <= c.maxSize {
+		return
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		if key != keep {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].used.Before(c.entries[keys[j]].used)
+	})
+
+	for _, key := range keys {
+		if c.total <= c.maxSize {
+			break
+		}
+		e := c.entries[key]
+		// an image being served stays readable until closed
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		c.total -= e.size
+		delete(c.entries, key)
+	}
+}
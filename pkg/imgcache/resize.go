@@ -0,0 +1,110 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package imgcache
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	_ "image/gif" // decoder
+	"image/jpeg"
+	"image/png"
+)
+
+// resize shrinks the image to fit in a dimension x dimension square,
+// keeping its ratio. Smaller images and the formats the standard library
+// can't decode (webp, svg...) are returned unchanged.
+// JPEG stay JPEG, the other formats are encoded as PNG.
+func resize(data []byte, contentType string, dimension int) ([]byte, string) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, contentType
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= dimension && h <= dimension {
+		return data, contentType
+	}
+	if w >= h {
+		w, h = dimension, atLeastOne(h*dimension/w)
+	} else {
+		w, h = atLeastOne(w*dimension/h), dimension
+	}
+
+	dst := shrink(src, w, h)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		contentType = "image/jpeg"
+	} else {
+		err = png.Encode(&buf, dst)
+		contentType = "image/png"
+	}
+	if err != nil {
+		return data, contentType
+	}
+
+	return buf.Bytes(), contentType
+}
+
+// shrink downscales src to w x h averaging the source pixels (box filter).
+func shrink(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	sw, sh := b.Dx(), b.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := y * sh / h
+		y1 := y0 + atLeastOne((y+1)*sh/h-y0)
+		for x := 0; x < w; x++ {
+			x0 := x * sw / w
+			x1 := x0 + atLeastOne((x+1)*sw/w-x0)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					bl += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+
+	return dst
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
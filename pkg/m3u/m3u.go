@@ -3,20 +3,28 @@ package m3u
 import (
 	"bufio"
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
+	"time"
 )
 
 // Playlist is a type that represents an m3u playlist containing 0 or more tracks or streams
 type Playlist struct {
+	// #EXTM3U header attributes, like url-tvg
+	Tags           []Tag
 	Tracks         []Track
 	VariantStreams []VariantStream
+	SessionData    []SessionData
+	// lines following the last track, kept as is
+	Trailer []string
+
+	header  rawLine
+	trailer []rawText
 }
 
 // A Tag is a simple key/value pair
@@ -32,6 +40,33 @@ type Track struct {
 	URI    string
 	Tags   []Tag
 	Group  string
+	// #EXTVLCOPT and #KODIPROP player options
+	VLCOpts   []Tag
+	KodiProps []Tag
+	// Lines of the entry other than #EXTINF and the URI, kept as is and in order:
+	// #EXTGRP, #EXTVLCOPT, unknown directives, comments...
+	// Group, VLCOpts and KodiProps are only written for tracks without Directives.
+	Directives []string
+	// Name as read, set by the callers renaming the track. It is not written.
+	OriginalName string
+
+	// position of the #EXTINF line among Directives
+	extinfAt int
+	extinf   rawLine
+	// Directives and URI as read
+	directives []rawText
+	uri        rawText
+}
+
+// Tag returns the value of the named tag, ignoring case, or "" if unset.
+func (t *Track) Tag(name string) string {
+	for _, tag := range t.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			return tag.Value
+		}
+	}
+
+	return ""
 }
 
 type VariantStream struct {
@@ -47,147 +82,110 @@ type VariantStream struct {
 	Subtitle        string
 	ClosedCaptions  string
 	URI             string
+
+	// the lines of the entry as read, and the number of tracks before it
+	directives []rawText
+	streamInf  rawText
+	inner      []rawText
+	uri        rawText
+	after      int
+}
+
+// SessionData is an HLS #EXT-X-SESSION-DATA entry
+type SessionData struct {
+	DataID   string
+	Value    string
+	URI      string
+	Language string
+
+	// read from a playlist, the line is written back with the entry following it
+	parsed bool
+}
+
+// httpClient fetches remote playlists, there is no overall timeout
+// because big lists take minutes to download, use a context instead.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
 }
 
 // Parse parses an m3u playlist with the given file name and returns a Playlist
 func Parse(fileName string) (Playlist, error) {
-	var f io.ReadCloser
+	var tracks []Track
+	p, err := ParseContext(context.Background(), fileName, func(t Track) error {
+		tracks = append(tracks, t)
+		return nil
+	})
+	if err != nil {
+		return Playlist{}, err
+	}
+	p.Tracks = tracks
 
-	if strings.HasPrefix(fileName, "http://") || strings.HasPrefix(fileName, "https://") {
-		data, err := http.Get(fileName)
-		if err != nil {
-			return Playlist{},
-				fmt.Errorf("unable to open playlist URL: %v", err)
-		}
-		f = data.Body
-	} else {
+	return p, nil
+}
+
+// ParseContext opens the playlist file or URL and decodes it, see Decode.
+func ParseContext(ctx context.Context, fileName string, fn func(Track) error) (Playlist, error) {
+	return (&Decoder{OnTrack: fn}).DecodeFile(ctx, fileName)
+}
+
+// DecodeFile opens the playlist file or URL and decodes it.
+func (d *Decoder) DecodeFile(ctx context.Context, fileName string) (Playlist, error) {
+	f, err := Open(ctx, fileName)
+	if err != nil {
+		return Playlist{}, err
+	}
+	defer f.Close()
+
+	return d.Decode(&contextReader{ctx, f})
+}
+
+// Open opens a playlist file or http(s) URL, the request is bound to ctx.
+func Open(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(fileName, "http://") && !strings.HasPrefix(fileName, "https://") {
 		file, err := os.Open(fileName)
 		if err != nil {
-			return Playlist{},
-				fmt.Errorf("unable to open playlist file: %v", err)
+			return nil, fmt.Errorf("unable to open playlist file: %v", err)
 		}
-		f = file
+		return file, nil
 	}
-	defer f.Close()
 
-	onFirstLine := true
-	scanner := bufio.NewScanner(f)
-	tagsRegExp, _ := regexp.Compile("([a-zA-Z0-9-]+?)=\"([^\"]+)\"")
-	playlist := Playlist{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open playlist URL: %v", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open playlist URL: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unable to open playlist URL: %s", resp.Status)
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if onFirstLine && !strings.HasPrefix(line, "#EXTM3U") {
-			return Playlist{},
-				errors.New("invalid m3u file format. Expected #EXTM3U file header")
-		}
+	return resp.Body, nil
+}
 
-		onFirstLine = false
+// contextReader stops reading once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-		if strings.HasPrefix(line, "#EXTINF") {
-			line := strings.Replace(line, "#EXTINF:", "", -1)
-			trackInfo := strings.Split(line, ",")
-			if len(trackInfo) < 2 {
-				return Playlist{},
-					errors.New("invalid m3u file format. Expected EXTINF metadata to contain track length and name data")
-			}
-			length, parseErr := strconv.Atoi(strings.Split(trackInfo[0], " ")[0])
-			if parseErr != nil {
-				return Playlist{}, errors.New("unable to parse length")
-			}
-			track := &Track{strings.Trim(trackInfo[1], " "), length, "", nil, ""}
-			tagList := tagsRegExp.FindAllString(line, -1)
-			for i := range tagList {
-				tagInfo := strings.Split(tagList[i], "=")
-				tag := &Tag{tagInfo[0], strings.Replace(tagInfo[1], "\"", "", -1)}
-				track.Tags = append(track.Tags, *tag)
-			}
-			playlist.Tracks = append(playlist.Tracks, *track)
-		} else if strings.HasPrefix(line, "#EXT-X-STREAM-INF") {
-			line := strings.Replace(line, "#EXT-X-STREAM-INF:", "", -1)
-			streamInfo := strings.Split(line, ",")
-			if len(streamInfo) < 1 {
-				return Playlist{},
-					errors.New("invalid m3u file format. Expected EXT-X-STREAM-INF metadata to contain bitrate data")
-			}
-			stream := &VariantStream{}
-			for _, param := range streamInfo {
-				if strings.HasPrefix(param, "BANDWIDTH") {
-					bandwidth := strings.Split(streamInfo[1], "=")[1]
-					bandwidthInt, parseErr := strconv.Atoi(bandwidth)
-					if parseErr != nil {
-						return Playlist{}, errors.New("unable to parse bandwidth")
-					}
-					stream.Bandwidth = bandwidthInt
-				}
-				if strings.HasPrefix(param, "AVERAGE-BANDWIDTH") {
-					averageBandwidth := strings.Split(streamInfo[1], "=")[1]
-					averageBandwidthInt, parseErr := strconv.Atoi(averageBandwidth)
-					if parseErr != nil {
-						return Playlist{}, errors.New("unable to parse average bandwidth")
-					}
-					stream.AverageBandwith = averageBandwidthInt
-				}
-				if strings.HasPrefix(param, "CODECS") {
-					codecs := strings.Split(streamInfo[1], "=")[1]
-					stream.Codecs = codecs
-				}
-				if strings.HasPrefix(param, "RESOLUTION") {
-					resolution := strings.Split(streamInfo[1], "=")[1]
-					stream.Resolution = resolution
-				}
-				if strings.HasPrefix(param, "FRAME-RATE") {
-					frameRate := strings.Split(streamInfo[1], "=")[1]
-					frameRateFloat, parseErr := strconv.ParseFloat(frameRate, 64)
-					if parseErr != nil {
-						return Playlist{}, errors.New("unable to parse frame rate")
-					}
-					stream.FrameRate = frameRateFloat
-				}
-				if strings.HasPrefix(param, "HDCP-LEVEL") {
-					hdcpLevel := strings.Split(streamInfo[1], "=")[1]
-					stream.HdcpLevel = hdcpLevel
-				}
-				if strings.HasPrefix(param, "VIDEO") {
-					video := strings.Split(streamInfo[1], "=")[1]
-					stream.Video = video
-				}
-				if strings.HasPrefix(param, "AUDIO") {
-					audio := strings.Split(streamInfo[1], "=")[1]
-					stream.Audio = audio
-				}
-				if strings.HasPrefix(param, "SUBTITLES") {
-					subtitle := strings.Split(streamInfo[1], "=")[1]
-					stream.Subtitle = subtitle
-				}
-				if strings.HasPrefix(param, "CLOSED-CAPTIONS") {
-					closedCaptions := strings.Split(streamInfo[1], "=")[1]
-					stream.ClosedCaptions = closedCaptions
-				}
-				if strings.HasPrefix(param, "NAME") {
-					name := strings.Split(streamInfo[1], "=")[1]
-					stream.Name = name
-				}
-			}
-			playlist.VariantStreams = append(playlist.VariantStreams, *stream)
-		} else if strings.HasPrefix(line, "#EXTGRP") {
-			line := strings.Replace(line, "#EXTINF:", "", -1)
-			playlist.Tracks[len(playlist.Tracks)-1].Group = strings.Trim(line, " ")
-
-		} else if strings.HasPrefix(line, "#") || line == "" {
-			continue
-		} else if len(playlist.Tracks) == 0 && len(playlist.VariantStreams) == 0 {
-			return Playlist{},
-				errors.New("URI provided for playlist with no tracks or streams")
-
-		} else if playlist.VariantStreams != nil {
-			playlist.VariantStreams[len(playlist.VariantStreams)-1].URI = strings.Trim(line, " ")
-		} else if playlist.VariantStreams == nil {
-			playlist.Tracks[len(playlist.Tracks)-1].URI = strings.Trim(line, " ")
-		}
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
 	}
 
-	return playlist, nil
+	return r.r.Read(p)
 }
 
 // Marshall Playlist to an m3u file.
@@ -202,21 +200,36 @@ func Marshall(p Playlist) (io.Reader, error) {
 }
 
 // MarshallInto a *bufio.Writer a Playlist.
+// A parsed playlist is written back byte for byte, but for what was changed.
 func MarshallInto(p Playlist, into *bufio.Writer) error {
-	_, _ = into.WriteString("#EXTM3U\n")
-	for _, track := range p.Tracks {
-		_, _ = into.WriteString("#EXTINF:")
-		_, _ = into.WriteString(fmt.Sprintf("%d ", track.Length))
-		for i := range track.Tags {
-			if i == len(track.Tags)-1 {
-				_, _ = into.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, track.Tags[i].Value))
-				continue
+	if err := WriteHeader(into, &p); err != nil {
+		return err
+	}
+	for i := range p.SessionData {
+		if err := WriteSessionData(into, &p.SessionData[i]); err != nil {
+			return err
+		}
+	}
+
+	v := 0
+	for i := range p.Tracks {
+		for ; v < len(p.VariantStreams) && p.VariantStreams[v].after <= i; v++ {
+			if err := WriteVariantStream(into, &p.VariantStreams[v]); err != nil {
+				return err
 			}
-			_, _ = into.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value))
 		}
-		_, _ = into.WriteString(", ")
+		if err := WriteTrack(into, &p.Tracks[i]); err != nil {
+			return err
+		}
+	}
+	for ; v < len(p.VariantStreams); v++ {
+		if err := WriteVariantStream(into, &p.VariantStreams[v]); err != nil {
+			return err
+		}
+	}
 
-		_, _ = into.WriteString(fmt.Sprintf("%s\n%s\n", track.Name, track.URI))
+	if err := WriteTrailer(into, &p); err != nil {
+		return err
 	}
 
 	return into.Flush()
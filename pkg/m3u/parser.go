@@ -0,0 +1,418 @@
+package m3u
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseError is a playlist syntax error, with the line it was found at.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("m3u: line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parser builds a Playlist line by line.
+type parser struct {
+	playlist Playlist
+	line     int
+	header   bool
+
+	// entries waiting for their URI line
+	track   *Track
+	variant *VariantStream
+	// an invalid entry, its URI line is ignored
+	skip bool
+	// #EXTGRP seen before the #EXTINF it applies to
+	group string
+	// lines read since the last URI, but #EXTINF, and as read
+	lines []string
+	raws  []rawText
+	// tracks decoded
+	tracks int
+
+	*Decoder
+}
+
+// Decoder decodes a playlist, calling its hooks as the entries are read.
+type Decoder struct {
+	// OnHeader is called once the #EXTM3U line is read,
+	// with a playlist only holding the header.
+	OnHeader func(Playlist) error
+	// OnTrack is called for every track, in order.
+	OnTrack func(Track) error
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return &ParseError{Line: p.line, Err: fmt.Errorf(format, a...)}
+}
+
+// skipf logs an invalid entry, skipped not to lose the whole playlist,
+// and drops the lines read for it.
+func (p *parser) skipf(format string, a ...interface{}) {
+	log.Printf("[iptv-proxy] %v | WARNING: %v, entry skipped\n", time.Now().Format("2006/01/02 - 15:04:05"), p.errorf(format, a...))
+	p.track, p.variant, p.lines, p.raws, p.group = nil, nil, nil, nil, ""
+}
+
+// Decode reads a playlist from r and calls onTrack for every track, in order,
+// without keeping them: the returned Playlist has no Tracks.
+// Decoding stops at the first error returned by onTrack.
+func Decode(r io.Reader, onTrack func(Track) error) (Playlist, error) {
+	return (&Decoder{OnTrack: onTrack}).Decode(r)
+}
+
+// Decode reads a playlist from r, the returned Playlist has no Tracks.
+// Decoding stops at the first error returned by a hook.
+func (d *Decoder) Decode(r io.Reader) (Playlist, error) {
+	p := &parser{Decoder: d}
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			p.line++
+			if err := p.parseLine(line); err != nil {
+				return Playlist{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Playlist{}, &ParseError{Line: p.line + 1, Err: err}
+		}
+	}
+
+	if !p.header {
+		return Playlist{}, &ParseError{Line: 1, Err: errors.New("invalid m3u file format. Expected #EXTM3U file header")}
+	}
+	p.playlist.Trailer, p.playlist.trailer = p.lines, p.raws
+
+	return p.playlist, nil
+}
+
+func (p *parser) parseLine(raw string) error {
+	line := raw
+	if p.line == 1 {
+		line = strings.TrimPrefix(line, "\ufeff")
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasSuffix(raw, "\n") {
+		// the last line, lines may be written in another order
+		raw += "\n"
+	}
+
+	if !p.header {
+		if line == "" {
+			p.raws = append(p.raws, rawText{raw: raw})
+			return nil
+		}
+		if !isDirective(line, "#EXTM3U") {
+			return p.errorf("invalid m3u file format. Expected #EXTM3U file header")
+		}
+		tags, _, err := parseAttributes(directiveValue(line, "#EXTM3U"), ' ')
+		if err != nil {
+			return p.errorf("#EXTM3U: %v", err)
+		}
+		p.playlist.Tags = tags
+		for _, blank := range p.raws {
+			raw = blank.raw + raw
+		}
+		p.playlist.header = newRawLine(raw, "", 0, tags)
+		p.header, p.raws = true, nil
+		if p.OnHeader != nil {
+			return p.OnHeader(p.playlist)
+		}
+		return nil
+	}
+
+	if line != "" && !strings.HasPrefix(line, "#") {
+		return p.parseURI(rawText{text: line, raw: raw})
+	}
+	if !isDirective(line, "#EXTINF") && !isDirective(line, "#EXT-X-STREAM-INF") {
+		p.lines = append(p.lines, line)
+		p.raws = append(p.raws, rawText{text: line, raw: raw})
+	}
+
+	switch {
+	case line == "":
+		return nil
+	case isDirective(line, "#EXTINF"):
+		if p.track != nil || p.variant != nil {
+			p.skipf("#EXTINF without URI")
+		}
+		track, err := parseExtinf(directiveValue(line, "#EXTINF"))
+		if err != nil {
+			p.skipf("#EXTINF: %v", err)
+			p.skip = true
+			return nil
+		}
+		p.skip = false
+		track.Group, p.group = p.group, ""
+		track.extinf = newRawLine(raw, track.Name, track.Length, track.Tags)
+		track.extinfAt = len(p.lines)
+		p.track = track
+	case isDirective(line, "#EXT-X-STREAM-INF"):
+		if p.track != nil || p.variant != nil {
+			p.skipf("#EXT-X-STREAM-INF without URI")
+		}
+		variant, err := parseStreamInf(directiveValue(line, "#EXT-X-STREAM-INF"))
+		if err != nil {
+			p.skipf("#EXT-X-STREAM-INF: %v", err)
+			p.skip = true
+			return nil
+		}
+		p.skip = false
+		variant.directives, variant.after = p.raws, p.tracks
+		variant.streamInf = rawText{text: formatStreamInf(variant), raw: raw}
+		p.lines, p.raws = nil, nil
+		p.variant = variant
+	case isDirective(line, "#EXT-X-SESSION-DATA"):
+		data, err := parseSessionData(directiveValue(line, "#EXT-X-SESSION-DATA"))
+		if err != nil {
+			log.Printf("[iptv-proxy] %v | WARNING: %v, ignored\n", time.Now().Format("2006/01/02 - 15:04:05"), p.errorf("#EXT-X-SESSION-DATA: %v", err))
+			return nil
+		}
+		// written back with the lines around it
+		data.parsed = true
+		p.playlist.SessionData = append(p.playlist.SessionData, data)
+	case isDirective(line, "#EXTGRP"):
+		group := strings.TrimSpace(directiveValue(line, "#EXTGRP"))
+		if p.track != nil {
+			p.track.Group = group
+		} else if !p.skip {
+			p.group = group
+		}
+	case isDirective(line, "#EXTVLCOPT"):
+		if p.track == nil {
+			return nil
+		}
+		p.track.VLCOpts = append(p.track.VLCOpts, parseOption(directiveValue(line, "#EXTVLCOPT")))
+	case isDirective(line, "#KODIPROP"):
+		if p.track == nil {
+			return nil
+		}
+		p.track.KodiProps = append(p.track.KodiProps, parseOption(directiveValue(line, "#KODIPROP")))
+	}
+
+	return nil
+}
+
+func (p *parser) parseURI(uri rawText) error {
+	switch {
+	case p.track != nil:
+		track := *p.track
+		track.URI, track.uri = uri.text, uri
+		track.Directives, track.directives = p.lines, p.raws
+		p.track, p.lines, p.raws = nil, nil, nil
+		p.tracks++
+		if p.OnTrack != nil {
+			return p.OnTrack(track)
+		}
+	case p.variant != nil:
+		p.variant.URI, p.variant.uri = uri.text, uri
+		p.variant.inner = p.raws
+		p.playlist.VariantStreams = append(p.playlist.VariantStreams, *p.variant)
+		p.variant, p.lines, p.raws = nil, nil, nil
+	case p.skip:
+		p.skip, p.lines, p.raws = false, nil, nil
+	default:
+		p.skipf("URI provided for playlist with no tracks or streams")
+	}
+
+	return nil
+}
+
+// isDirective reports whether the line is the given directive,
+// and not only a directive starting with the same name.
+func isDirective(line, name string) bool {
+	if len(line) < len(name) || !strings.EqualFold(line[:len(name)], name) {
+		return false
+	}
+
+	return len(line) == len(name) || line[len(name)] == ':' || line[len(name)] == ' '
+}
+
+// directiveValue returns what follows the directive name and its colon.
+func directiveValue(line, name string) string {
+	v := line[len(name):]
+	if strings.HasPrefix(v, ":") {
+		v = v[1:]
+	}
+
+	return v
+}
+
+// parseExtinf parses `<length> key="value" ...,<title>`,
+// the title being everything after the first comma outside quotes.
+func parseExtinf(s string) (*Track, error) {
+	i := strings.IndexAny(s, " \t,")
+	if i < 0 {
+		return nil, errors.New("expected EXTINF metadata to contain track length and name data")
+	}
+
+	length, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse length %q", s[:i])
+	}
+
+	tags, rest, err := parseAttributes(s[i:], ' ')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rest, ",") {
+		return nil, errors.New("expected EXTINF metadata to contain track length and name data")
+	}
+
+	return &Track{
+		Name:   strings.TrimSpace(rest[1:]),
+		Length: int(length),
+		Tags:   tags,
+	}, nil
+}
+
+// parseStreamInf parses an HLS variant attribute list.
+func parseStreamInf(s string) (*VariantStream, error) {
+	attrs, _, err := parseAttributes(s, ',')
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &VariantStream{}
+	for _, attr := range attrs {
+		switch strings.ToUpper(attr.Name) {
+		case "BANDWIDTH":
+			if stream.Bandwidth, err = strconv.Atoi(attr.Value); err != nil {
+				return nil, errors.New("unable to parse bandwidth")
+			}
+		case "AVERAGE-BANDWIDTH":
+			if stream.AverageBandwith, err = strconv.Atoi(attr.Value); err != nil {
+				return nil, errors.New("unable to parse average bandwidth")
+			}
+		case "FRAME-RATE":
+			if stream.FrameRate, err = strconv.ParseFloat(attr.Value, 64); err != nil {
+				return nil, errors.New("unable to parse frame rate")
+			}
+		case "CODECS":
+			stream.Codecs = attr.Value
+		case "RESOLUTION":
+			stream.Resolution = attr.Value
+		case "HDCP-LEVEL":
+			stream.HdcpLevel = attr.Value
+		case "VIDEO":
+			stream.Video = attr.Value
+		case "AUDIO":
+			stream.Audio = attr.Value
+		case "SUBTITLES":
+			stream.Subtitle = attr.Value
+		case "CLOSED-CAPTIONS":
+			stream.ClosedCaptions = attr.Value
+		case "NAME":
+			stream.Name = attr.Value
+		}
+	}
+
+	return stream, nil
+}
+
+func parseSessionData(s string) (SessionData, error) {
+	attrs, _, err := parseAttributes(s, ',')
+	if err != nil {
+		return SessionData{}, err
+	}
+
+	var data SessionData
+	for _, attr := range attrs {
+		switch strings.ToUpper(attr.Name) {
+		case "DATA-ID":
+			data.DataID = attr.Value
+		case "VALUE":
+			data.Value = attr.Value
+		case "URI":
+			data.URI = attr.Value
+		case "LANGUAGE":
+			data.Language = attr.Value
+		}
+	}
+	if data.DataID == "" {
+		return SessionData{}, errors.New("missing DATA-ID")
+	}
+
+	return data, nil
+}
+
+// parseOption parses a `key=value` #EXTVLCOPT or #KODIPROP option.
+func parseOption(s string) Tag {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		return Tag{Name: s[:i], Value: s[i+1:]}
+	}
+
+	return Tag{Name: s}
+}
+
+// parseAttributes tokenizes a `key=value` list separated by sep (and blanks).
+// Values may be double or single quoted, quoted values may contain separators.
+// With a blank separator the list ends at the first comma outside quotes,
+// which is returned in rest with what follows.
+func parseAttributes(s string, sep byte) (attrs []Tag, rest string, err error) {
+	i := 0
+	for {
+		for i < len(s) && (isBlank(s[i]) || s[i] == sep) {
+			i++
+		}
+		if i == len(s) {
+			return attrs, "", nil
+		}
+		if s[i] == ',' {
+			return attrs, s[i:], nil
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && s[i] != ',' && s[i] != sep && !isBlank(s[i]) {
+			i++
+		}
+		name := s[start:i]
+		if i == len(s) || s[i] != '=' {
+			// a bare word, ignored
+			continue
+		}
+		i++
+
+		var value string
+		if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+			quote := s[i]
+			end := strings.IndexByte(s[i+1:], quote)
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated quoted value for %q", name)
+			}
+			value = s[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			start := i
+			for i < len(s) && s[i] != ',' && s[i] != sep && !isBlank(s[i]) {
+				i++
+			}
+			value = s[start:i]
+		}
+
+		attrs = append(attrs, Tag{Name: name, Value: value})
+	}
+}
+
+func isBlank(b byte) bool {
+	return b == ' ' || b == '\t'
+}
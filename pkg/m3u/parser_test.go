@@ -0,0 +1,171 @@
+package m3u
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// decode parses a playlist, keeping its tracks.
+func decode(s string) (Playlist, error) {
+	var tracks []Track
+	p, err := Decode(strings.NewReader(s), func(t Track) error {
+		tracks = append(tracks, t)
+		return nil
+	})
+	p.Tracks = tracks
+
+	return p, err
+}
+
+func quiet(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestDecode(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name     string
+		input    string
+		tracks   []string // name=URI
+		variants []string
+		err      bool
+	}{
+		{
+			name:   "tracks",
+			input:  "#EXTM3U\n#EXTINF:-1 tvg-id=\"a\",A\nhttp://a\n#EXTINF:10,B\nhttp://b\n",
+			tracks: []string{"A=http://a", "B=http://b"},
+		},
+		{
+			name:   "bom and crlf",
+			input:  "\ufeff#EXTM3U\r\n#EXTINF:-1,A\r\nhttp://a\r\n",
+			tracks: []string{"A=http://a"},
+		},
+		{
+			name:   "quoted comma in attributes",
+			input:  "#EXTM3U\n#EXTINF:-1 tvg-name=\"x, y\" group-title='G',A, B\nhttp://a\n",
+			tracks: []string{"A, B=http://a"},
+		},
+		{
+			name:   "extinf without uri",
+			input:  "#EXTM3U\n#EXTINF:-1,A\n#EXTINF:-1,B\nhttp://b\n",
+			tracks: []string{"B=http://b"},
+		},
+		{
+			name:   "invalid extinf",
+			input:  "#EXTM3U\n#EXTINF:x,A\nhttp://a\n#EXTINF:-1,B\nhttp://b\n",
+			tracks: []string{"B=http://b"},
+		},
+		{
+			name:   "unterminated quote",
+			input:  "#EXTM3U\n#EXTINF:-1 tvg-id=\"a,A\nhttp://a\n#EXTINF:-1,B\nhttp://b\n",
+			tracks: []string{"B=http://b"},
+		},
+		{
+			name:     "stream-inf without uri",
+			input:    "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n#EXTINF:-1,A\nhttp://a\n#EXT-X-STREAM-INF:BANDWIDTH=2\nlow.m3u8\n",
+			tracks:   []string{"A=http://a"},
+			variants: []string{"low.m3u8"},
+		},
+		{
+			name:   "uri without entry",
+			input:  "#EXTM3U\nhttp://orphan\n#EXTINF:-1,A\nhttp://a\n",
+			tracks: []string{"A=http://a"},
+		},
+		{
+			name:  "no header",
+			input: "#EXTINF:-1,A\nhttp://a\n",
+			err:   true,
+		},
+		{
+			name:  "empty",
+			input: "",
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := decode(tt.input)
+			if tt.err {
+				var perr *ParseError
+				if !errors.As(err, &perr) {
+					t.Fatalf("got error %v, want a ParseError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var tracks []string
+			for _, track := range p.Tracks {
+				tracks = append(tracks, track.Name+"="+track.URI)
+			}
+			if strings.Join(tracks, "\n") != strings.Join(tt.tracks, "\n") {
+				t.Errorf("got tracks %q, want %q", tracks, tt.tracks)
+			}
+			var variants []string
+			for _, v := range p.VariantStreams {
+				variants = append(variants, v.URI)
+			}
+			if strings.Join(variants, "\n") != strings.Join(tt.variants, "\n") {
+				t.Errorf("got variants %q, want %q", variants, tt.variants)
+			}
+		})
+	}
+}
+
+func TestDecodeGroup(t *testing.T) {
+	p, err := decode("#EXTM3U\n#EXTGRP:Before\n#EXTINF:-1,A\nhttp://a\n#EXTINF:-1,B\n#EXTGRP:After\nhttp://b\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tracks) != 2 || p.Tracks[0].Group != "Before" || p.Tracks[1].Group != "After" {
+		t.Errorf("got %+v", p.Tracks)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	quiet(f)
+
+	f.Add("#EXTM3U url-tvg=\"http://guide\"\n#EXTINF:-1 tvg-id=\"a\" group-title=\"G\",A\n#EXTVLCOPT:http-user-agent=x\nhttp://a\n")
+	f.Add("#EXTM3U\r\n#EXTGRP:G\r\n#EXTINF:0,A\r\n#KODIPROP:k=v\r\nhttp://a\r\n# trailer\r\n")
+	f.Add("#EXTM3U\n#EXT-X-SESSION-DATA:DATA-ID=\"id\",VALUE=\"v\"\n#EXT-X-STREAM-INF:BANDWIDTH=1,RESOLUTION=1x1\nlow.m3u8\n")
+	f.Add("#EXTM3U\n#EXTINF:-1,A\n#EXTINF:x,B\nhttp://b\nhttp://c\n")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		p, err := decode(input)
+		if err != nil {
+			return
+		}
+
+		// what is written is read back the same
+		r, err := Marshall(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if _, err := io.Copy(&b, r); err != nil {
+			t.Fatal(err)
+		}
+		again, err := decode(b.String())
+		if err != nil {
+			t.Fatalf("marshalled playlist: %v\n%q", err, b.String())
+		}
+		if len(again.Tracks) != len(p.Tracks) {
+			t.Fatalf("got %d tracks, want %d\n%q", len(again.Tracks), len(p.Tracks), b.String())
+		}
+		for i := range p.Tracks {
+			if again.Tracks[i].Name != p.Tracks[i].Name || again.Tracks[i].URI != p.Tracks[i].URI {
+				t.Fatalf("track %d: got %q %q, want %q %q", i, again.Tracks[i].Name, again.Tracks[i].URI, p.Tracks[i].Name, p.Tracks[i].URI)
+			}
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package m3u
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// rawText is a line as read, with its line ending, and the text it was
+// parsed from.
+type rawText struct {
+	text string
+	raw  string
+}
+
+// write writes the line as read if its text is unchanged.
+func (r rawText) write(b *strings.Builder, text, eol string) {
+	if r.raw != "" && r.text == text {
+		b.WriteString(r.raw)
+		return
+	}
+	writeLine(b, text, eol)
+}
+
+// eol returns the line ending of the raw line, "\n" by default.
+func (r rawText) eol() string {
+	if strings.HasSuffix(r.raw, "\r\n") {
+		return "\r\n"
+	}
+
+	return "\n"
+}
+
+// rawLine is a parsed line, written back as is
+// as long as the fields it was parsed into are unchanged.
+type rawLine struct {
+	rawText
+	name   string
+	length int
+	tags   []Tag
+}
+
+func newRawLine(raw, name string, length int, tags []Tag) rawLine {
+	return rawLine{rawText: rawText{raw: raw}, name: name, length: length, tags: append([]Tag(nil), tags...)}
+}
+
+func (r *rawLine) matches(name string, length int, tags []Tag) bool {
+	if r.raw == "" || r.name != name || r.length != length || len(r.tags) != len(tags) {
+		return false
+	}
+	for i := range tags {
+		if r.tags[i] != tags[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WriteHeader writes the #EXTM3U line with the playlist attributes.
+func WriteHeader(w io.Writer, p *Playlist) error {
+	line := p.header.raw
+	if !p.header.matches("", 0, p.Tags) {
+		line = "#EXTM3U" + FormatTags(p.Tags) + p.header.eol()
+	}
+
+	_, err := io.WriteString(w, line)
+
+	return err
+}
+
+// WriteTrack writes a track entry, its directives and its URI.
+func WriteTrack(w io.Writer, t *Track) error {
+	eol := t.extinf.eol()
+	extinf := t.extinf.raw
+	if !t.extinf.matches(t.Name, t.Length, t.Tags) {
+		extinf = "#EXTINF:" + strconv.Itoa(t.Length) + FormatTags(t.Tags) + "," + t.Name + eol
+	}
+
+	var b strings.Builder
+	if t.Directives == nil {
+		b.WriteString(extinf)
+		if t.Group != "" {
+			writeLine(&b, "#EXTGRP:"+t.Group, eol)
+		}
+		for _, opt := range t.VLCOpts {
+			writeLine(&b, "#EXTVLCOPT:"+opt.Name+"="+opt.Value, eol)
+		}
+		for _, prop := range t.KodiProps {
+			writeLine(&b, "#KODIPROP:"+prop.Name+"="+prop.Value, eol)
+		}
+	} else {
+		at := t.extinfAt
+		if at > len(t.Directives) {
+			at = len(t.Directives)
+		}
+		for i, line := range t.Directives {
+			if i == at {
+				b.WriteString(extinf)
+			}
+			t.directive(i).write(&b, line, eol)
+		}
+		if at == len(t.Directives) {
+			b.WriteString(extinf)
+		}
+	}
+	t.uri.write(&b, t.URI, eol)
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// directive returns the i-th directive as read, none if they were changed.
+func (t *Track) directive(i int) rawText {
+	if len(t.directives) != len(t.Directives) {
+		return rawText{}
+	}
+
+	return t.directives[i]
+}
+
+// WriteVariantStream writes an HLS variant stream entry and its URI.
+func WriteVariantStream(w io.Writer, v *VariantStream) error {
+	eol := v.streamInf.eol()
+
+	var b strings.Builder
+	for _, line := range v.directives {
+		b.WriteString(line.raw)
+	}
+	v.streamInf.write(&b, formatStreamInf(v), eol)
+	for _, line := range v.inner {
+		b.WriteString(line.raw)
+	}
+	v.uri.write(&b, v.URI, eol)
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// WriteSessionData writes an #EXT-X-SESSION-DATA line, but for the parsed
+// ones: they are written with the lines of the entry following them.
+func WriteSessionData(w io.Writer, d *SessionData) error {
+	if d.parsed {
+		return nil
+	}
+
+	attrs := []Tag{{Name: "DATA-ID", Value: d.DataID}}
+	if d.Value != "" {
+		attrs = append(attrs, Tag{Name: "VALUE", Value: d.Value})
+	}
+	if d.URI != "" {
+		attrs = append(attrs, Tag{Name: "URI", Value: d.URI})
+	}
+	if d.Language != "" {
+		attrs = append(attrs, Tag{Name: "LANGUAGE", Value: d.Language})
+	}
+	_, err := io.WriteString(w, "#EXT-X-SESSION-DATA:"+formatAttributes(attrs)+"\n")
+
+	return err
+}
+
+// WriteTrailer writes the lines following the last track.
+func WriteTrailer(w io.Writer, p *Playlist) error {
+	eol := p.header.eol()
+	var b strings.Builder
+	for i, line := range p.Trailer {
+		raw := rawText{}
+		if len(p.trailer) == len(p.Trailer) {
+			raw = p.trailer[i]
+		}
+		raw.write(&b, line, eol)
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func writeLine(b *strings.Builder, line, eol string) {
+	b.WriteString(line)
+	b.WriteString(eol)
+}
+
+// FormatTags formats attributes as ` key="value"`, values containing
+// a double quote are single quoted as m3u has no escaping.
+func FormatTags(tags []Tag) string {
+	var b strings.Builder
+	for _, tag := range tags {
+		quote := `"`
+		if strings.Contains(tag.Value, `"`) {
+			quote = `'`
+		}
+		b.WriteString(" " + tag.Name + "=" + quote + tag.Value + quote)
+	}
+
+	return b.String()
+}
+
+// formatStreamInf formats the #EXT-X-STREAM-INF line of a variant stream.
+func formatStreamInf(v *VariantStream) string {
+	var attrs []Tag
+	add := func(name, value string) {
+		if value != "" && value != "0" {
+			attrs = append(attrs, Tag{Name: name, Value: value})
+		}
+	}
+	add("BANDWIDTH", strconv.Itoa(v.Bandwidth))
+	add("AVERAGE-BANDWIDTH", strconv.Itoa(v.AverageBandwith))
+	add("CODECS", v.Codecs)
+	add("RESOLUTION", v.Resolution)
+	add("FRAME-RATE", strconv.FormatFloat(v.FrameRate, 'f', -1, 64))
+	add("HDCP-LEVEL", v.HdcpLevel)
+	add("AUDIO", v.Audio)
+	add("VIDEO", v.Video)
+	add("SUBTITLES", v.Subtitle)
+	add("CLOSED-CAPTIONS", v.ClosedCaptions)
+	add("NAME", v.Name)
+
+	return "#EXT-X-STREAM-INF:" + formatAttributes(attrs)
+}
+
+// formatAttributes formats an HLS attribute list, the enumerated and
+// numeric values unquoted.
+func formatAttributes(attrs []Tag) string {
+	parts := make([]string, 0, len(attrs))
+	for _, attr := range attrs {
+		value := attr.Value
+		switch attr.Name {
+		case "BANDWIDTH", "AVERAGE-BANDWIDTH", "RESOLUTION", "FRAME-RATE", "HDCP-LEVEL":
+		case "CLOSED-CAPTIONS":
+			if value != "NONE" {
+				value = `"` + value + `"`
+			}
+		default:
+			value = `"` + value + `"`
+		}
+		parts = append(parts, attr.Name+"="+value)
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,131 @@
+package m3u
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func marshall(t *testing.T, p Playlist) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := MarshallInto(p, bufio.NewWriter(&b)); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.m3u")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no fixtures: %v", err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			want, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := Parse(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := marshall(t, p); got != string(want) {
+				t.Errorf("got\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTripRewrittenURI(t *testing.T) {
+	want, err := os.ReadFile("testdata/iptv.m3u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse("testdata/iptv.m3u")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uris := map[string]string{
+		"http://example.com/live/user/pass/1001.ts":   "http://proxy/live/u/p/1001.ts",
+		"http://example.com/live/user/pass/1002.m3u8": "http://proxy/live/u/p/1002.m3u8",
+		"http://example.com/movie/user/pass/2001.mkv": "http://proxy/movie/u/p/2001.mkv",
+	}
+	for i := range p.Tracks {
+		p.Tracks[i].URI = uris[p.Tracks[i].URI]
+	}
+
+	// the URI lines only, with their line ending
+	expected := strings.NewReplacer(
+		"\r\nhttp://example.com/live/user/pass/1001.ts\r\n", "\r\nhttp://proxy/live/u/p/1001.ts\r\n",
+		"\r\n  http://example.com/live/user/pass/1002.m3u8  \r\n", "\r\nhttp://proxy/live/u/p/1002.m3u8\r\n",
+		"\r\nhttp://example.com/movie/user/pass/2001.mkv\r\n", "\r\nhttp://proxy/movie/u/p/2001.mkv\r\n",
+	).Replace(string(want))
+	if got := marshall(t, p); got != expected {
+		t.Errorf("got\n%q\nwant\n%q", got, expected)
+	}
+}
+
+func TestWriteChangedTrack(t *testing.T) {
+	p, err := Parse("testdata/iptv.m3u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Tags = append(p.Tags, Tag{Name: "x-tvg-url", Value: "http://proxy/epg.xml"})
+	p.Tracks[0].Tags = p.Tracks[0].Tags[:1]
+	p.Tracks[1].Directives[1] = "#EXTVLCOPT:http-user-agent=VLC"
+	p.Tracks = p.Tracks[:2]
+
+	got := strings.Split(marshall(t, p), "\r\n")
+	want := []string{
+		`#EXTM3U url-tvg="http://epg.example.com/guide.xml.gz" tvg-shift="1" catchup="shift" x-tvg-url="http://proxy/epg.xml"`,
+		`#EXTINF:-1 tvg-id="france2.fr",France 2 HD`,
+		"#EXTVLCOPT:http-user-agent=Mozilla/5.0",
+		"#EXTVLCOPT:http-referrer=http://example.com/",
+		"http://example.com/live/user/pass/1001.ts",
+		"",
+		"#EXTVLCOPT:http-user-agent=VLC",
+	}
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("got\n%q\nwant\n%q", got, want)
+		}
+	}
+}
+
+func TestWriteNewPlaylist(t *testing.T) {
+	p := Playlist{
+		Tags: []Tag{{Name: "url-tvg", Value: "http://epg"}},
+		Tracks: []Track{{
+			Name:    "A",
+			Length:  -1,
+			URI:     "http://a",
+			Tags:    []Tag{{Name: "tvg-name", Value: `a "b"`}},
+			Group:   "G",
+			VLCOpts: []Tag{{Name: "http-user-agent", Value: "x"}},
+		}},
+		VariantStreams: []VariantStream{{Bandwidth: 1000, Resolution: "640x360", Codecs: "avc1", URI: "low.m3u8"}},
+		SessionData:    []SessionData{{DataID: "id", Value: "v"}},
+	}
+
+	want := `#EXTM3U url-tvg="http://epg"
+#EXT-X-SESSION-DATA:DATA-ID="id",VALUE="v"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CODECS="avc1",RESOLUTION=640x360
+low.m3u8
+#EXTINF:-1 tvg-name='a "b"',A
+#EXTGRP:G
+#EXTVLCOPT:http-user-agent=x
+http://a
+`
+	if got := marshall(t, p); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package procgroup runs the external commands, ffmpeg, in their own
+// process group: they are killed with their children, and the ones
+// still running can all be killed when the proxy exits.
+package procgroup
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+)
+
+var (
+	lock    sync.Mutex
+	running = make(map[*exec.Cmd]struct{})
+)
+
+// Command returns the command of name in a new process group, killed
+// with its group when ctx is done.
+func Command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	setGroup(cmd)
+	cmd.Cancel = func() error {
+		return kill(cmd)
+	}
+
+	return cmd
+}
+
+// Start starts a command, it is tracked until Wait returns.
+func Start(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	running[cmd] = struct{}{}
+
+	return nil
+}
+
+// Wait waits for a command started with Start.
+func Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	delete(running, cmd)
+
+	return err
+}
+
+// Kill kills the process group of a command started with Start.
+func Kill(cmd *exec.Cmd) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// the group id may have been reused once waited for
+	if _, ok := running[cmd]; !ok {
+		return nil
+	}
+
+	return kill(cmd)
+}
+
+// KillAll kills the process groups of the commands still running.
+func KillAll() int {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for cmd := range running {
+		_ = kill(cmd)
+	}
+
+	return len(running)
+}
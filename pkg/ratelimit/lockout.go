@@ -0,0 +1,210 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Lockout counts the failed attempts per key: beyond threshold, the key
+// is locked out, twice longer after each new failure.
+type Lockout struct {
+	threshold int
+	base, max time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failures
+}
+
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// NewLockout returns a lockout of base after threshold failures, doubled
+// after each other one up to max. The failures are forgotten after max
+// without any.
+func NewLockout(threshold int, base, max time.Duration) *Lockout {
+	return &Lockout{
+		threshold: threshold,
+		base:      base,
+		max:       max,
+		failures:  make(map[string]*failures),
+	}
+}
+
+// Locked returns the remaining lockout of a key, 0 if it isn't locked.
+func (l *Lockout) Locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.failures[key]
+	if f == nil {
+		return 0
+	}
+	if remaining := time.Until(f.until); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// Fail counts a failure of the key, it returns the resulting lockout,
+// 0 below the threshold.
+func (l *Lockout) Fail(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	f := l.failures[key]
+	if f == nil || now.Sub(f.last) > l.max {
+		f = &failures{}
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < l.threshold {
+		return 0
+	}
+
+	lockout := l.base
+	for i := l.threshold; i < f.count && lockout < l.max; i++ {
+		lockout *= 2
+	}
+	if lockout > l.max {
+		lockout = l.max
+	}
+	f.until = now.Add(lockout)
+
+	return lockout
+}
+
+// Succeed forgets the failures of a key.
+func (l *Lockout) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, key)
+}
+
+// Count returns the number of locked keys.
+func (l *Lockout) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for _, f := range l.failures {
+		if f.until.After(now) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Run forgets the old failures, until ctx is done.
+func (l *Lockout) Run(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.cleanup()
+		}
+	}
+}
+
+func (l *Lockout) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, f := range l.failures {
+		if now.Sub(f.last) > l.max && now.After(f.until) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// Known remembers the keys seen during the last ttl.
+type Known struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewKnown returns the keys seen during the last ttl.
+func NewKnown(ttl time.Duration) *Known {
+	return &Known{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Add marks a key as seen now.
+func (k *Known) Add(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.seen[key] = time.Now()
+}
+
+// Contains reports whether a key was seen during the last ttl.
+func (k *Known) Contains(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	seen, ok := k.seen[key]
+
+	return ok && time.Since(seen) <= k.ttl
+}
+
+// Run forgets the keys not seen during the last ttl, until ctx is done.
+func (k *Known) Run(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.cleanup()
+		}
+	}
+}
+
+func (k *Known) cleanup() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for key, seen := range k.seen {
+		if time.Since(seen) > k.ttl {
+			delete(k.seen, key)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/access"
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/gin-gonic/gin"
+)
+
+// The global rules apply to all the requests, before authentication,
+// the users ones once they are authenticated. The client IP comes from
+// X-Forwarded-For only behind the trusted proxies.
+
+// newAccessRules parses the global and users rules, and opens the
+// countries database.
+func (c *Config) newAccessRules() error {
+	var err error
+	if c.access, err = access.New(c.Allow, c.Deny, c.AllowCountries, c.DenyCountries); err != nil {
+		return err
+	}
+
+	countries := c.access != nil && c.access.HasCountries()
+	c.userAccess = make(map[string]*access.Rules)
+	for _, u := range c.Users.Users() {
+		rules, err := access.New(u.Allow, u.Deny, u.AllowCountries, u.DenyCountries)
+		if err != nil {
+			return err
+		}
+		if rules != nil {
+			c.userAccess[u.Username.String()] = rules
+			countries = countries || rules.HasCountries()
+		}
+	}
+
+	if c.GeoIPDatabase == "" {
+		if countries {
+			return errors.New("the country rules need --geoip-db")
+		}
+		return nil
+	}
+	c.geoip, err = access.OpenGeoIP(c.GeoIPDatabase)
+
+	return err
+}
+
+// accessControl applies the global rules.
+func (c *Config) accessControl(ctx *gin.Context) {
+	if c.access == nil || trustedDevice(ctx) || c.allows(ctx, c.access) {
+		return
+	}
+
+	log.Printf("[iptv-proxy] %v | %s |Access denied\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+	ctx.AbortWithStatus(http.StatusForbidden)
+}
+
+// localNetwork refuses the clients out of the local network, except the
+// trusted devices.
+func (c *Config) localNetwork(ctx *gin.Context) {
+	if ip, err := netip.ParseAddr(ctx.ClientIP()); err == nil && !access.Public(ip.Unmap()) || trustedDevice(ctx) {
+		return
+	}
+
+	log.Printf("[iptv-proxy] %v | %s |Access denied out of the local network\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+	ctx.AbortWithStatus(http.StatusForbidden)
+}
+
+// userAllowed applies the rules of an authenticated user, the request
+// is aborted when denied.
+func (c *Config) userAllowed(ctx *gin.Context, user *config.UserAccount) bool {
+	rules := c.userAccess[user.Username.String()]
+	if rules == nil || c.allows(ctx, rules) {
+		return true
+	}
+
+	log.Printf("[iptv-proxy] %v | %s |Access denied to %q\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), user.Username)
+	ctx.AbortWithStatus(http.StatusForbidden)
+
+	return false
+}
+
+func (c *Config) allows(ctx *gin.Context, rules *access.Rules) bool {
+	ip, err := netip.ParseAddr(ctx.ClientIP())
+	if err != nil {
+		return false
+	}
+
+	return rules.Allows(ip, func(ip netip.Addr) string {
+		if c.geoip == nil {
+			return ""
+		}
+		return c.geoip.Country(ip)
+	})
+}
@@ -0,0 +1,541 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/gin-gonic/gin"
+)
+
+// Catch-up (archive) TV.
+// Proxified tracks with an archive are published in "append" mode: players
+// add ?utc=<start>&lutc=<now> to the live URL, which is translated to the
+// provider timeshift format by the stream handlers.
+
+const catchupSource = "?utc={utc}&lutc={lutc}"
+
+// default duration when the player only gives the start time
+const defaultCatchupDuration = 2 * time.Hour
+
+// catchupWindow is the requested archive time range.
+type catchupWindow struct {
+	start    time.Time
+	duration time.Duration
+}
+
+// xtream provider timezone, timeshift URLs are in the provider local time
+var xtreamLocation *time.Location
+var xtreamLocationLock = sync.Mutex{}
+
+// HLS archives are proxified: the URIs of their playlists (variants,
+// segments, keys) are rewritten to /catchup/<user>/<password>/<ref>,
+// ref being the provider URL encrypted as it may hold credentials.
+var hlsURIAttributeRegexp = regexp.MustCompile(`URI="([^"]*)"`)
+
+// newCatchup loads the playlist catch-up timezone and draws the archive URLs key.
+func (c *Config) newCatchup() error {
+	c.catchupLocation = time.Local
+	if c.CatchupTimezone != "" {
+		loc, err := time.LoadLocation(c.CatchupTimezone)
+		if err != nil {
+			return fmt.Errorf("catch-up timezone: %w", err)
+		}
+		c.catchupLocation = loc
+	}
+
+	c.catchupKey = make([]byte, 32)
+	_, err := rand.Read(c.catchupKey)
+
+	return err
+}
+
+// localLocation returns the timezone of the emulated xtream server, the
+// playlist catch-up one or UTC: the name of the local one is unknown.
+func (c *Config) localLocation() *time.Location {
+	if c.catchupLocation == nil || c.catchupLocation == time.Local {
+		return time.UTC
+	}
+
+	return c.catchupLocation
+}
+
+// catchupRequest returns the archive window of a stream request,
+// from the utc/lutc or start/end/duration query parameters (unix time, seconds).
+// ok is false for live requests.
+func catchupRequest(ctx *gin.Context) (w catchupWindow, ok bool, err error) {
+	start := ctx.Query("utc")
+	if start == "" {
+		start = ctx.Query("start")
+	}
+	if start == "" {
+		return catchupWindow{}, false, nil
+	}
+
+	utc, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return catchupWindow{}, true, fmt.Errorf("invalid catch-up start %q", start)
+	}
+	w.start = time.Unix(utc, 0)
+
+	if d := ctx.Query("duration"); d != "" {
+		seconds, err := strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			return catchupWindow{}, true, fmt.Errorf("invalid catch-up duration %q", d)
+		}
+		w.duration = time.Duration(seconds) * time.Second
+	} else if end := firstQuery(ctx, "end", "lutc"); end != "" {
+		endUTC, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return catchupWindow{}, true, fmt.Errorf("invalid catch-up end %q", end)
+		}
+		w.duration = time.Unix(endUTC, 0).Sub(w.start)
+	}
+	if w.duration <= 0 {
+		w.duration = defaultCatchupDuration
+	}
+
+	return w, true, nil
+}
+
+func firstQuery(ctx *gin.Context, keys ...string) string {
+	for _, k := range keys {
+		if v := ctx.Query(k); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// catchupDays returns the archive depth of a track, 0 if it has none.
+func catchupDays(track *m3u.Track) int {
+	for _, name := range []string{"catchup-days", "tvg-rec", "timeshift"} {
+		if days, err := strconv.Atoi(track.Tag(name)); err == nil && days > 0 {
+			return days
+		}
+	}
+	if track.Tag("catchup") != "" || track.Tag("catchup-source") != "" {
+		return 1
+	}
+
+	return 0
+}
+
+// catchupTags returns the track tags with the catch-up attributes
+// pointing to the proxy, the provider ones are never published.
+func catchupTags(track *m3u.Track) []m3u.Tag {
+	days := catchupDays(track)
+	if days == 0 {
+		return track.Tags
+	}
+
+	tags := make([]m3u.Tag, 0, len(track.Tags)+3)
+	for _, tag := range track.Tags {
+		switch strings.ToLower(tag.Name) {
+		case "catchup", "catchup-type", "catchup-days", "catchup-source":
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	return append(tags,
+		m3u.Tag{Name: "catchup", Value: "append"},
+		m3u.Tag{Name: "catchup-days", Value: strconv.Itoa(days)},
+		m3u.Tag{Name: "catchup-source", Value: catchupSource},
+	)
+}
+
+// xtreamTimeshiftURL returns the provider timeshift URL of a live stream id ("1234.ts").
+func (c *Config) xtreamTimeshiftURL(ctx *gin.Context, id string, w catchupWindow) (*url.URL, error) {
+	loc := c.xtreamLocation(ctx)
+	ext := path.Ext(id)
+	if ext == "" {
+		ext = ".ts"
+	}
+
+	return url.Parse(fmt.Sprintf(
+		"%s/timeshift/%s/%s/%d/%s/%s%s",
+		c.XtreamBaseURL,
+		c.XtreamUser,
+		c.XtreamPassword,
+		int(w.duration.Minutes()+0.5),
+		w.start.In(loc).Format("2006-01-02:15-04"),
+		strings.TrimSuffix(id, path.Ext(id)),
+		ext,
+	))
+}
+
+// xtreamLocation returns the provider timezone, from its login response.
+func (c *Config) xtreamLocation(ctx *gin.Context) *time.Location {
+	xtreamLocationLock.Lock()
+	defer xtreamLocationLock.Unlock()
+
+	if xtreamLocation != nil {
+		return xtreamLocation
+	}
+
+	client, err := c.xtreamAPI.Client(ctx.Request.UserAgent())
+	if err != nil {
+		return time.UTC
+	}
+
+	xtreamLocation = time.UTC
+	if loc, err := time.LoadLocation(client.ServerInfo.Timezone); err == nil {
+		xtreamLocation = loc
+	}
+
+	return xtreamLocation
+}
+
+var catchupPlaceholderRegexp = regexp.MustCompile(`\$?\{([A-Za-z]+)(?::([^}]*))?\}`)
+
+// catchupURL returns the archive URL of an m3u track, following its catchup mode,
+// the times being in the provider timezone loc.
+func catchupURL(track *m3u.Track, w catchupWindow, loc *time.Location) (*url.URL, error) {
+	mode := strings.ToLower(track.Tag("catchup"))
+	if mode == "" {
+		mode = strings.ToLower(track.Tag("catchup-type"))
+	}
+	source := track.Tag("catchup-source")
+
+	var template string
+	switch mode {
+	case "", "default":
+		if source == "" {
+			return nil, errors.New("no catch-up source")
+		}
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			template = source
+		} else {
+			template = appendQuery(track.URI, source)
+		}
+	case "append":
+		template = appendQuery(track.URI, source)
+	case "shift", "timeshift":
+		template = appendQuery(track.URI, "?utc={utc}&lutc={lutc}")
+	case "flussonic", "flussonic-hls", "flussonic-ts", "fs":
+		template = flussonicTemplate(track.URI)
+	case "xc":
+		template = xtreamTemplate(track.URI)
+	default:
+		return nil, fmt.Errorf("unsupported catch-up mode %q", mode)
+	}
+	if template == "" {
+		return nil, fmt.Errorf("unable to build the %q catch-up URL of %q", mode, track.Name)
+	}
+
+	return url.Parse(expandCatchup(template, w, loc))
+}
+
+// appendQuery appends a source starting with "?" or "&" to an URL.
+func appendQuery(uri, source string) string {
+	if strings.HasPrefix(source, "?") && strings.Contains(uri, "?") {
+		return uri + "&" + source[1:]
+	}
+
+	return uri + source
+}
+
+// flussonicTemplate turns a flussonic live URL in an archive one:
+// .../index.m3u8 → .../archive-{utc}-{duration}.m3u8, .../mpegts → .../timeshift_abs-{utc}.ts
+func flussonicTemplate(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	dir, file := path.Split(u.Path)
+	switch {
+	case strings.HasSuffix(file, ".m3u8"):
+		u.Path = dir + "archive-{utc}-{duration}.m3u8"
+	case file == "mpegts":
+		u.Path = dir + "timeshift_abs-{utc}.ts"
+	default:
+		return ""
+	}
+
+	// don't escape the placeholders
+	s := u.String()
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(s)
+}
+
+// xtreamTemplate turns an xtream live URL (/live/user/pass/id.ts or /user/pass/id)
+// in a timeshift one.
+func xtreamTemplate(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) > 0 && parts[0] == "live" {
+		parts = parts[1:]
+	}
+	if len(parts) != 3 {
+		return ""
+	}
+
+	id := parts[2]
+	if path.Ext(id) == "" {
+		id += ".ts"
+	}
+
+	return fmt.Sprintf("%s://%s/timeshift/%s/%s/{duration:60}/{Y}-{m}-{d}:{H}-{M}/%s", u.Scheme, u.Host, parts[0], parts[1], id)
+}
+
+// expandCatchup replaces the catch-up placeholders of the template:
+// {utc}, {start}, {lutc}, {now}, {utcend}, {end}, {duration}, {offset},
+// with an optional divider ({duration:60} is in minutes), and the
+// {Y}, {m}, {d}, {H}, {M}, {S} start date parts in the loc timezone.
+func expandCatchup(template string, w catchupWindow, loc *time.Location) string {
+	now := time.Now()
+	end := w.start.Add(w.duration)
+	start := w.start.In(loc)
+
+	return catchupPlaceholderRegexp.ReplaceAllStringFunc(template, func(m string) string {
+		sub := catchupPlaceholderRegexp.FindStringSubmatch(m)
+		name, arg := sub[1], sub[2]
+
+		var v int64
+		switch strings.ToLower(name) {
+		case "utc", "start", "timestamp":
+			v = w.start.Unix()
+		case "lutc", "now":
+			v = now.Unix()
+		case "utcend", "end":
+			v = end.Unix()
+		case "duration":
+			v = int64(w.duration.Seconds())
+		case "offset":
+			v = int64(now.Sub(w.start).Seconds())
+		default:
+			switch name {
+			case "Y":
+				return fmt.Sprintf("%04d", start.Year())
+			case "m":
+				return fmt.Sprintf("%02d", int(start.Month()))
+			case "d":
+				return fmt.Sprintf("%02d", start.Day())
+			case "H":
+				return fmt.Sprintf("%02d", start.Hour())
+			case "M":
+				return fmt.Sprintf("%02d", start.Minute())
+			case "S":
+				return fmt.Sprintf("%02d", start.Second())
+			}
+			return m
+		}
+
+		if div, err := strconv.ParseInt(arg, 10, 64); err == nil && div > 0 {
+			v /= div
+		}
+
+		return strconv.FormatInt(v, 10)
+	})
+}
+
+// serveTrackCatchup streams the archive of an m3u track on catch-up requests,
+// it returns false for live ones.
+func (c *Config) serveTrackCatchup(ctx *gin.Context, track *m3u.Track) bool {
+	w, ok, err := catchupRequest(ctx)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return true
+	}
+
+	c.streamTrackCatchup(ctx, track, w)
+
+	return true
+}
+
+func (c *Config) streamTrackCatchup(ctx *gin.Context, track *m3u.Track, w catchupWindow) {
+	rpURL, err := catchupURL(track, w, c.catchupLocation)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+
+	if strings.HasSuffix(rpURL.Path, ".m3u8") {
+		c.hlsArchive(ctx, rpURL)
+		return
+	}
+
+	c.stream(ctx, rpURL)
+}
+
+// serveXtreamCatchup streams the provider timeshift of a live stream
+// on catch-up requests, it returns false for live ones.
+func (c *Config) serveXtreamCatchup(ctx *gin.Context) bool {
+	w, ok, err := catchupRequest(ctx)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return true
+	}
+
+	rpURL, err := c.xtreamTimeshiftURL(ctx, ctx.Param("id"), w)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return true
+	}
+
+	c.xtreamStream(ctx, rpURL)
+
+	return true
+}
+
+// archiveRef encrypts a provider URL of an HLS archive.
+func (c *Config) archiveRef(u *url.URL) (string, error) {
+	aead, err := c.archiveAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(u.String()), nil)), nil
+}
+
+// archiveURL decrypts the provider URL of an archive ref.
+func (c *Config) archiveURL(ref string) (*url.URL, error) {
+	aead, err := c.archiveAEAD()
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(ref)
+	if err != nil || len(b) < aead.NonceSize() {
+		return nil, errors.New("invalid archive ref")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("invalid archive ref")
+	}
+
+	return url.Parse(string(plain))
+}
+
+func (c *Config) archiveAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.catchupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// archiveProxy serves a resource of a proxified HLS archive.
+func (c *Config) archiveProxy(ctx *gin.Context) {
+	ref := ctx.Param("ref")
+	u, err := c.archiveURL(strings.TrimSuffix(ref, path.Ext(ref)))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+
+	if strings.HasSuffix(u.Path, ".m3u8") {
+		c.hlsArchive(ctx, u)
+		return
+	}
+	c.stream(ctx, u)
+}
+
+// hlsArchive serves an HLS archive playlist, its URIs pointing to the proxy.
+func (c *Config) hlsArchive(ctx *gin.Context, rpURL *url.URL) {
+	resp, err := c.openStream(ctx.Request.Context(), rpURL, nil)
+	if errors.Is(err, errStreamLimit) {
+		_ = ctx.AbortWithError(http.StatusServiceUnavailable, err) // nolint: errcheck
+		return
+	}
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		_ = ctx.AbortWithError(resp.StatusCode, fmt.Errorf("archive: %s", resp.Status)) // nolint: errcheck
+		return
+	}
+
+	// playlists are small, a few thousand segments at most
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	// the URIs are relative to the playlist, once redirected
+	base := resp.Request.URL
+	rewrite := c.userURLs(ctx)
+	proxify := func(uri string) string {
+		u, err := base.Parse(uri)
+		if err != nil {
+			return uri
+		}
+		ref, err := c.archiveRef(u)
+		if err != nil {
+			return uri
+		}
+		proxified := c.advertisedURL(fmt.Sprintf("/catchup/%s/%s/%s%s", c.User.PathEscape(), c.Password.PathEscape(), ref, path.Ext(u.Path)))
+		if rewrite != nil {
+			proxified = rewrite(proxified)
+		}
+		return proxified
+	}
+
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		text := strings.TrimSpace(line)
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, "#"):
+			lines[i] = hlsURIAttributeRegexp.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + proxify(attr[len(`URI="`):len(attr)-1]) + `"`
+			})
+		default:
+			lines[i] = proxify(text) + line[len(strings.TrimRight(line, "\r")):]
+		}
+	}
+
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(strings.Join(lines, "\n")))
+}
@@ -0,0 +1,424 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/dvr"
+	"github.com/buga1234/iptv-proxy/pkg/epg"
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/gin-gonic/gin"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// Recordings are published as Xtream movies, in their own category,
+// and as a group of the m3u playlists.
+
+const (
+	dvrGroup = "Recordings"
+	// Xtream ids of the recordings category and streams (+ recording id),
+	// out of the providers ranges
+	dvrCategoryID = 2000000000
+	dvrStreamID   = 2000000000
+)
+
+func (c *Config) newDVR() (*dvr.DVR, error) {
+	return dvr.New(c.DVRDir, c.DVRFormat, time.Duration(c.DVRPadding)*time.Minute, c.dvrOpen, c.dvrGuide)
+}
+
+// dvrChannel returns the upstream URL, the guide id and the original
+// name of a published channel.
+func (c *Config) dvrChannel(ctx context.Context, channel string) (*url.URL, string, string, error) {
+	for i := range c.playlist.Tracks {
+		track := &c.playlist.Tracks[i]
+		if strings.EqualFold(track.Name, channel) {
+			u, err := url.Parse(track.URI)
+			return u, track.Tag("tvg-id"), track.Name, err
+		}
+	}
+
+	if c.xtreamAPI != nil {
+		resp, _, err := c.xtreamAPI.Action(ctx, "", "get_live_streams", nil)
+		if err != nil {
+			return nil, "", "", err
+		}
+		streams, _ := resp.([]xtream.Stream)
+		for _, stream := range streams {
+			if name, ok := c.Filter.Name(stream.Name); ok && strings.EqualFold(name, channel) {
+				u, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%d.ts", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, stream.ID))
+				return u, stream.EPGChannelID, stream.Name, err
+			}
+		}
+	}
+
+	return nil, "", "", fmt.Errorf("unknown channel %q", channel)
+}
+
+// dvrOpen opens the live stream of a channel for a recording.
+func (c *Config) dvrOpen(ctx context.Context, channel string) (io.ReadCloser, error) {
+	u, _, _, err := c.dvrChannel(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.openLive(ctx, u)
+	if errors.Is(err, errStreamLimit) {
+		return nil, dvr.ErrBusy
+	}
+
+	return r, err
+}
+
+// dvrGuide returns the guide listings of a channel.
+func (c *Config) dvrGuide(ctx context.Context, channel string, from time.Time) []epg.Listing {
+	if c.epg == nil {
+		return nil
+	}
+	_, id, name, err := c.dvrChannel(ctx, channel)
+	if err != nil {
+		return nil
+	}
+	if id = c.epg.ChannelID(id, name); id == "" {
+		return nil
+	}
+
+	return c.epg.Listings(id, from, 0)
+}
+
+func (c *Config) dvrRoutes(r *gin.RouterGroup) {
+	if c.dvr == nil {
+		return
+	}
+
+	r.GET("/dvr/schedules", c.authenticate, c.dvrSchedules)
+	r.POST("/dvr/schedules", c.authenticate, c.dvrAddSchedule)
+	r.DELETE("/dvr/schedules/:id", c.authenticate, c.dvrRemoveSchedule)
+	r.GET("/dvr/recordings", c.authenticate, c.dvrRecordings)
+	r.DELETE("/dvr/recordings/:id", c.authenticate, c.dvrRemoveRecording)
+
+	// with an Xtream backend, the movie route serves both
+	if c.XtreamBaseURL == "" {
+		c.streamRoute(r, "/movie/%s/%s/:id", func(ctx *gin.Context) {
+			if !c.serveRecording(ctx) {
+				ctx.AbortWithStatus(http.StatusNotFound)
+			}
+		})
+	}
+}
+
+func (c *Config) dvrSchedules(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.dvr.Schedules())
+}
+
+// dvrScheduleForm is a new schedule, see dvr.Schedule.
+type dvrScheduleForm struct {
+	Channel  string `form:"channel" binding:"required"`
+	Name     string `form:"name"`
+	Start    string `form:"start"`
+	Stop     string `form:"stop"`
+	Days     string `form:"days"` // "mon,wed,fri"
+	Time     string `form:"time"`
+	Duration int    `form:"duration"`
+	Title    string `form:"title"`
+}
+
+// parseScheduleTime parses an RFC 3339 or a local "2006-01-02 15:04" time.
+func parseScheduleTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02 15:04", s, time.Local); err != nil {
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+func (c *Config) dvrAddSchedule(ctx *gin.Context) {
+	var form dvrScheduleForm
+	if err := ctx.ShouldBind(&form); err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	s := dvr.Schedule{
+		Channel:  form.Channel,
+		Name:     form.Name,
+		Time:     form.Time,
+		Duration: form.Duration,
+		Title:    form.Title,
+	}
+	var err error
+	if s.Start, err = parseScheduleTime(form.Start); err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	if s.Stop, err = parseScheduleTime(form.Stop); err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	for _, day := range strings.Split(form.Days, ",") {
+		if day = strings.TrimSpace(day); day != "" {
+			s.Days = append(s.Days, day)
+		}
+	}
+
+	if _, _, _, err := c.dvrChannel(ctx.Request.Context(), s.Channel); err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	if s, err = c.dvr.AddSchedule(s); err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, s)
+}
+
+func (c *Config) dvrRemoveSchedule(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil || !c.dvr.RemoveSchedule(id) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *Config) dvrRecordings(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, c.dvr.Recordings())
+}
+
+func (c *Config) dvrRemoveRecording(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil || !c.dvr.RemoveRecording(id) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// recordingURL returns the published URL of a recording.
+func (c *Config) recordingURL(r *dvr.Recording) string {
+	return c.advertisedURL(fmt.Sprintf("/movie/%s/%s/%d%s", c.User.PathEscape(), c.Password.PathEscape(), dvrStreamID+r.ID, path.Ext(r.File)))
+}
+
+// playableRecordings returns the recordings with data, running ones included.
+func (c *Config) playableRecordings() []dvr.Recording {
+	if c.dvr == nil {
+		return nil
+	}
+
+	var ret []dvr.Recording
+	for _, r := range c.dvr.Recordings() {
+		if r.Status == dvr.StatusCompleted || r.Status == dvr.StatusRecording || r.Size > 0 {
+			ret = append(ret, r)
+		}
+	}
+
+	return ret
+}
+
+// serveRecording serves a recording requested as an Xtream movie,
+// it returns false if the movie is not a recording.
+func (c *Config) serveRecording(ctx *gin.Context) bool {
+	if c.dvr == nil {
+		return false
+	}
+	id := ctx.Param("id")
+	streamID, err := strconv.Atoi(strings.TrimSuffix(id, path.Ext(id)))
+	if err != nil || streamID <= dvrStreamID {
+		return false
+	}
+
+	r, ok := c.dvr.Recording(streamID - dvrStreamID)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return true
+	}
+	if _, err := os.Stat(c.dvr.Path(&r)); err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return true
+	}
+
+	ctx.File(c.dvr.Path(&r))
+
+	return true
+}
+
+// writeRecordingTracks writes the recordings group of the m3u playlists.
+func (c *Config) writeRecordingTracks(w io.Writer) error {
+	for _, r := range c.playableRecordings() {
+		track := m3u.Track{
+			Name:   fmt.Sprintf("%s (%s)", r.Title, r.Start.Local().Format("2006-01-02 15:04")),
+			Length: int(r.Duration().Seconds()),
+			Tags:   []m3u.Tag{{Name: "group-title", Value: dvrGroup}},
+			URI:    c.recordingURL(&r),
+		}
+		if err := m3u.WriteTrack(w, &track); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func recordingStream(r *dvr.Recording, num int) xtream.Stream {
+	added := xtream.Timestamp{Time: r.Start}
+	return xtream.Stream{
+		Added:              &added,
+		CategoryID:         dvrCategoryID,
+		CategoryName:       dvrGroup,
+		ContainerExtension: strings.TrimPrefix(path.Ext(r.File), "."),
+		ID:                 xtream.FlexInt(dvrStreamID + r.ID),
+		Name:               fmt.Sprintf("%s (%s)", r.Title, r.Start.Local().Format("2006-01-02 15:04")),
+		Number:             xtream.FlexInt(num),
+		Type:               "movie",
+	}
+}
+
+// dvrXtreamAction answers the player_api.php actions on the recordings only,
+// ok is false for the other requests.
+func (c *Config) dvrXtreamAction(action string, q url.Values) (resp interface{}, ok bool) {
+	if c.dvr == nil {
+		return nil, false
+	}
+
+	switch action {
+	case "get_vod_streams":
+		if q.Get("category_id") != strconv.Itoa(dvrCategoryID) {
+			return nil, false
+		}
+		return c.dvrXtreamResponse(action, q, []xtream.Stream{}), true
+
+	case "get_vod_info":
+		id, err := strconv.Atoi(q.Get("vod_id"))
+		if err != nil || id <= dvrStreamID {
+			return nil, false
+		}
+		r, found := c.dvr.Recording(id - dvrStreamID)
+		if !found {
+			return []struct{}{}, true
+		}
+		var info xtream.VideoOnDemandInfo
+		info.Info.Plot = r.Description
+		secs := int(r.Duration().Seconds())
+		info.Info.Duration = fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+		info.Info.DurationSecs = xtream.FlexInt(secs)
+		info.Info.ReleaseDate = r.Start.Format("2006-01-02")
+		info.MovieData.Added = xtream.Timestamp{Time: r.Start}
+		info.MovieData.CategoryID = dvrCategoryID
+		info.MovieData.ContainerExtension = strings.TrimPrefix(path.Ext(r.File), ".")
+		info.MovieData.Name = r.Title
+		info.MovieData.StreamID = xtream.FlexInt(id)
+		return &info, true
+	}
+
+	return nil, false
+}
+
+// dvrXtreamResponse adds the recordings to the VOD categories and streams.
+func (c *Config) dvrXtreamResponse(action string, q url.Values, resp interface{}) interface{} {
+	if c.dvr == nil {
+		return resp
+	}
+
+	switch action {
+	case "get_vod_categories":
+		categories, _ := resp.([]xtream.Category)
+		return append(categories, xtream.Category{ID: dvrCategoryID, Name: dvrGroup})
+
+	case "get_vod_streams":
+		if cat := q.Get("category_id"); cat != "" && cat != strconv.Itoa(dvrCategoryID) {
+			return resp
+		}
+		streams, _ := resp.([]xtream.Stream)
+		n := len(streams)
+		for i, r := range c.playableRecordings() {
+			streams = append(streams, recordingStream(&r, n+i+1))
+		}
+		return streams
+	}
+
+	return resp
+}
+
+// serveM3UFile serves a proxified playlist, followed by the recordings.
+func (c *Config) serveM3UFile(ctx *gin.Context, path string) {
+	rewrite := c.userURLs(ctx)
+	if rewrite == nil && len(c.playableRecordings()) == 0 {
+		ctx.File(path)
+		return
+	}
+
+	var recordings bytes.Buffer
+	if err := c.writeRecordingTracks(&recordings); err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	var playlist io.Reader
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer f.Close()
+		playlist = f
+	case os.IsNotExist(err) && recordings.Len() > 0:
+		// no playlist, the recordings only
+		var header bytes.Buffer
+		if err := c.marshallHeader(&header, &m3u.Playlist{}); err != nil {
+			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		playlist = &header
+	case os.IsNotExist(err):
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	default:
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+	r := io.MultiReader(playlist, &recordings)
+	if rewrite != nil {
+		err = rewritePlaylist(ctx.Writer, r, rewrite, c.epgURL(c.mainUser()), c.epgURL(requestUser(ctx)))
+	} else {
+		_, err = io.Copy(ctx.Writer, r)
+	}
+	if err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/buga1234/iptv-proxy/pkg/epg"
+	"github.com/gin-gonic/gin"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// newEPGCache returns the guide cache for the configured sources, or nil if there is none.
+// The Xtream provider guide comes first, external guides complete it.
+func (c *Config) newEPGCache() *epg.Cache {
+	var sources []epg.FetchFunc
+	if c.XtreamBaseURL != "" {
+		sources = append(sources, c.xtreamEPGSource)
+	}
+	for _, source := range c.EPGSources {
+		source := source
+		sources = append(sources, func(ctx context.Context) (io.ReadCloser, error) {
+			return epg.Open(ctx, source)
+		})
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	expiration := time.Duration(c.EPGCacheExpiration) * time.Hour
+	if expiration <= 0 {
+		expiration = 12 * time.Hour
+	}
+
+	return epg.NewCache(sources, c.epgLineup, expiration)
+}
+
+func (c *Config) xtreamEPGSource(ctx context.Context) (io.ReadCloser, error) {
+	return epg.Open(ctx, fmt.Sprintf(
+		"%s/xmltv.php?username=%s&password=%s",
+		c.XtreamBaseURL,
+		url.QueryEscape(c.XtreamUser.String()),
+		url.QueryEscape(c.XtreamPassword.String()),
+	))
+}
+
+// epgLineup returns the published channels: the proxified playlist tracks
+// and, with an Xtream backend, the provider live streams.
+func (c *Config) epgLineup(ctx context.Context) (*epg.Lineup, error) {
+	lineup := epg.NewLineup()
+
+	// the tracks are already filtered, matched by the provider name as
+	// the guide doesn't know the renames
+	for _, track := range c.playlist.Tracks {
+		name := track.Name
+		if track.OriginalName != "" {
+			name = track.OriginalName
+		}
+		lineup.Add(track.Tag("tvg-id"), name, track.Name)
+	}
+
+	if c.XtreamBaseURL == "" {
+		return lineup, nil
+	}
+
+	// the guide is shared by the users, only the global filter rules apply
+	resp, _, err := c.xtreamAPI.Action(ctx, "", "get_live_streams", nil)
+	if err != nil {
+		return nil, err
+	}
+	streams, _ := resp.([]xtream.Stream)
+	categories := c.xtreamAPI.CategoryNames(ctx, "", "get_live_categories")
+
+	for _, stream := range streams {
+		if excludedTrackRegexp.MatchString(stream.Name) {
+			continue
+		}
+		if _, ok := c.filterCategory(nil, categories[fmt.Sprint(stream.CategoryID)]); !ok {
+			continue
+		}
+		name, ok := c.Filter.Name(stream.Name)
+		if !ok {
+			continue
+		}
+		lineup.Add(stream.EPGChannelID, stream.Name, name)
+	}
+
+	return lineup, nil
+}
+
+// guideToken returns the token standing for the user credentials in the
+// guide URL, it gives access to the guide only.
+func guideToken(user *config.UserAccount) string {
+	mac := hmac.New(sha256.New, []byte(user.SigningKey()))
+	fmt.Fprintf(mac, "%s\nepg", user.Username)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// epgURL returns the advertised guide URL of a user, or "" if there is no guide.
+func (c *Config) epgURL(user *config.UserAccount) string {
+	if c.epg == nil || user == nil {
+		return ""
+	}
+
+	return c.advertisedURL(fmt.Sprintf("/epg/%s/%s/epg.xml", user.Username.PathEscape(), guideToken(user)))
+}
+
+func (c *Config) epgRoutes(r *gin.RouterGroup) {
+	if c.epg == nil {
+		return
+	}
+
+	r.GET("/epg.xml", c.authenticate, c.serveEPG)
+	r.GET("/epg.xml.gz", c.authenticate, c.serveEPGGzip)
+	r.GET("/epg/:username/:token/epg.xml", c.guideAuthenticate, c.serveEPG)
+	r.GET("/epg/:username/:token/epg.xml.gz", c.guideAuthenticate, c.serveEPGGzip)
+}
+
+// guideAuthenticate authenticates the guide requests carrying a guide token.
+func (c *Config) guideAuthenticate(ctx *gin.Context) {
+	username := ctx.Param("username")
+	if c.lockedOut(ctx, username) {
+		return
+	}
+	user, ok := c.Users.User(username)
+	if !ok || !hmac.Equal([]byte(ctx.Param("token")), []byte(guideToken(user))) {
+		c.authFailed(ctx, username)
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.authSucceeded(ctx, username)
+	if !c.userAllowed(ctx, user) {
+		return
+	}
+	ctx.Set(userContextKey, user)
+}
+
+// serveEPGGzip serves the cached guide as a .gz file.
+func (c *Config) serveEPGGzip(ctx *gin.Context) {
+	c.serveEPGFile(ctx, true, "application/gzip")
+}
+
+// serveEPG serves the cached guide, gzip-compressed when the client accepts it.
+func (c *Config) serveEPG(ctx *gin.Context) {
+	gz := strings.Contains(ctx.GetHeader("Accept-Encoding"), "gzip")
+	if gz {
+		ctx.Header("Content-Encoding", "gzip")
+	}
+	ctx.Header("Vary", "Accept-Encoding")
+
+	c.serveEPGFile(ctx, gz, "application/xml")
+}
+
+func (c *Config) serveEPGFile(ctx *gin.Context, gz bool, contentType string) {
+	file, f, err := c.epg.Open(ctx.Request.Context(), gz)
+	if err != nil {
+		ctx.Writer.Header().Del("Content-Encoding")
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	etag := f.ETag
+	if gz {
+		etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+	}
+
+	// ServeContent answers If-None-Match with a 304 from the ETag.
+	ctx.Header("ETag", etag)
+	ctx.Header("Content-Type", contentType)
+	http.ServeContent(ctx.Writer, ctx.Request, "", f.ModTime, file)
+}
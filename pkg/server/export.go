@@ -0,0 +1,230 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/gin-gonic/gin"
+)
+
+// Alternate renderings of the proxified playlist, selected with ?format=.
+
+// exportTrack is a proxified playlist track.
+type exportTrack struct {
+	*m3u.Track
+	Number int
+	Group  string
+	// proxified URL, the original one is Track.URI
+	URI  string
+	Logo string
+}
+
+type exportFormat struct {
+	contentType string
+	fileName    string
+	render      func(c *Config, w *bufio.Writer, tracks []exportTrack, guide string) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"enigma2": {"text/plain; charset=utf-8", "userbouquet.iptv-proxy.tv", renderEnigma2},
+	"xspf":    {"application/xspf+xml", "iptv-proxy.xspf", renderXSPF},
+	"json":    {"application/json", "iptv-proxy.json", renderJSON},
+	"kodi":    {"application/octet-stream", "iptv-proxy.m3u", renderKodi},
+}
+
+// exportTracks returns the proxified playlist tracks, with the URLs of the m3u playlist.
+func (c *Config) exportTracks() []exportTrack {
+	tracks := make([]exportTrack, 0, len(c.playlist.Tracks))
+	for i := range c.playlist.Tracks {
+		track := &c.playlist.Tracks[i]
+		uri, err := c.trackURL(track, i, false)
+		if err != nil {
+			log.Printf("ERROR: track: %s: %s", track.Name, err)
+			continue
+		}
+
+		number := i + 1
+		if chno, err := strconv.Atoi(track.Tag("tvg-chno")); err == nil {
+			number = chno
+		}
+
+		tracks = append(tracks, exportTrack{
+			Track:  track,
+			Number: number,
+			Group:  trackGroup(track),
+			URI:    uri,
+			Logo:   c.imageURL(track.Tag("tvg-logo")),
+		})
+	}
+
+	return tracks
+}
+
+// exportPlaylist renders the playlist in the requested format,
+// it returns false if the format is unknown.
+func (c *Config) exportPlaylist(ctx *gin.Context, format string) bool {
+	f, ok := exportFormats[format]
+	if !ok {
+		return false
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, f.fileName))
+	ctx.Header("Content-Type", f.contentType)
+	ctx.Status(http.StatusOK)
+
+	tracks := c.exportTracks()
+	if rewrite := c.userURLs(ctx); rewrite != nil {
+		for i := range tracks {
+			tracks[i].URI = rewrite(tracks[i].URI)
+		}
+	}
+
+	w := bufio.NewWriter(ctx.Writer)
+	if err := f.render(c, w, tracks, c.epgURL(requestUser(ctx))); err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+		return true
+	}
+	if err := w.Flush(); err != nil {
+		_ = ctx.Error(err) // nolint: errcheck
+	}
+
+	return true
+}
+
+// renderEnigma2 renders an Enigma2 userbouquet, with a marker per group.
+func renderEnigma2(c *Config, w *bufio.Writer, tracks []exportTrack, guide string) error {
+	_, _ = w.WriteString("#NAME iptv-proxy\n")
+
+	group := ""
+	for i, t := range tracks {
+		if i == 0 || t.Group != group {
+			group = t.Group
+			if group != "" {
+				_, _ = fmt.Fprintf(w, "#SERVICE 1:64:%X:0:0:0:0:0:0:0::%s\n#DESCRIPTION %s\n", i+1, group, group)
+			}
+		}
+
+		// 4097 is the gstreamer service type, the SID must be unique for the EPG.
+		uri := strings.ReplaceAll(t.URI, ":", "%3a")
+		_, _ = fmt.Fprintf(w, "#SERVICE 4097:0:1:%X:0:0:0:0:0:0:%s:%s\n#DESCRIPTION %s\n", i+1, uri, t.Name, t.Name)
+	}
+
+	return nil
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	Album    string `xml:"album,omitempty"`
+	Image    string `xml:"image,omitempty"`
+	TrackNum int    `xml:"trackNum"`
+}
+
+// renderXSPF renders an XSPF playlist for VLC, the group is the album.
+func renderXSPF(c *Config, w *bufio.Writer, tracks []exportTrack, guide string) error {
+	p := xspfPlaylist{Version: 1, Title: "iptv-proxy", Tracks: make([]xspfTrack, 0, len(tracks))}
+	for _, t := range tracks {
+		p.Tracks = append(p.Tracks, xspfTrack{
+			Location: t.URI,
+			Title:    t.Name,
+			Album:    t.Group,
+			Image:    t.Logo,
+			TrackNum: t.Number,
+		})
+	}
+
+	_, _ = w.WriteString(xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(p); err != nil {
+		return err
+	}
+	_, err := w.WriteString("\n")
+
+	return err
+}
+
+type jsonChannel struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	Group  string `json:"group"`
+	Logo   string `json:"logo,omitempty"`
+	TVGID  string `json:"tvg_id,omitempty"`
+	URL    string `json:"url"`
+}
+
+// renderJSON renders the channel list as JSON.
+func renderJSON(c *Config, w *bufio.Writer, tracks []exportTrack, guide string) error {
+	channels := make([]jsonChannel, 0, len(tracks))
+	for _, t := range tracks {
+		channels = append(channels, jsonChannel{
+			Number: t.Number,
+			Name:   t.Name,
+			Group:  t.Group,
+			Logo:   t.Logo,
+			TVGID:  t.Tag("tvg-id"),
+			URL:    t.URI,
+		})
+	}
+
+	return json.NewEncoder(w).Encode(channels)
+}
+
+// renderKodi renders an m3u playlist with the #KODIPROP lines
+// selecting the right inputstream addon for Kodi PVR IPTV Simple.
+func renderKodi(c *Config, w *bufio.Writer, tracks []exportTrack, guide string) error {
+	header := "#EXTM3U"
+	if guide != "" {
+		header += m3u.FormatTags([]m3u.Tag{{Name: "url-tvg", Value: guide}})
+	}
+	_, _ = w.WriteString(header + "\n")
+
+	for _, t := range tracks {
+		_, _ = fmt.Fprintf(w, "#EXTINF:%d%s,%s\n", t.Length, m3u.FormatTags(c.imageTags(catchupTags(t.Track))), t.Name)
+
+		if u, err := url.Parse(t.URI); err == nil && path.Ext(u.Path) == ".m3u8" {
+			_, _ = w.WriteString("#KODIPROP:inputstream=inputstream.adaptive\n")
+			_, _ = w.WriteString("#KODIPROP:inputstream.adaptive.manifest_type=hls\n")
+		} else {
+			_, _ = w.WriteString("#KODIPROP:inputstream=inputstream.ffmpegdirect\n")
+			_, _ = w.WriteString("#KODIPROP:inputstream.ffmpegdirect.is_realtime_stream=true\n")
+		}
+		_, _ = w.WriteString(t.URI + "\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/gin-gonic/gin"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// The filter rules apply to the m3u playlists and to the xtream
+// player_api.php responses, users may also hide xtream categories.
+
+// userContextKey is the gin context key of the authenticated user.
+const userContextKey = "iptv-proxy-user"
+
+// requestUser returns the authenticated user of the request, nil if unknown.
+func requestUser(ctx *gin.Context) *config.UserAccount {
+	u, ok := ctx.Get(userContextKey)
+	if !ok {
+		return nil
+	}
+	user, _ := u.(*config.UserAccount)
+
+	return user
+}
+
+// mainUser returns the proxy user, the one of the generated playlists.
+func (c *Config) mainUser() *config.UserAccount {
+	user, _ := c.Users.User(c.User.String())
+
+	return user
+}
+
+// filterTrack applies the filter rules to a track, it returns false if
+// the track is not published.
+func (c *Config) filterTrack(track *m3u.Track) bool {
+	if excludedTrackRegexp.MatchString(track.Name) {
+		return false
+	}
+	if c.Filter == nil {
+		return true
+	}
+
+	group, ok := c.Filter.Group(trackGroup(track))
+	if !ok {
+		return false
+	}
+	name, ok := c.Filter.Name(track.Name)
+	if !ok {
+		return false
+	}
+
+	if name != track.Name && track.OriginalName == "" {
+		track.OriginalName = track.Name
+	}
+	track.Name = name
+	if track.Group != "" && track.Group != group {
+		track.Group = group
+		track.Directives = groupDirectives(track.Directives, group)
+	}
+	for i := range track.Tags {
+		if strings.EqualFold(track.Tags[i].Name, "group-title") && track.Tags[i].Value != group {
+			// copy, the tags may be shared with the parsed track
+			track.Tags = append([]m3u.Tag(nil), track.Tags...)
+			track.Tags[i].Value = group
+		}
+	}
+
+	return true
+}
+
+// groupDirectives returns the track directives with the #EXTGRP ones set
+// to group, copied as they may be shared with the parsed track.
+func groupDirectives(directives []string, group string) []string {
+	if directives == nil {
+		return nil
+	}
+
+	copied := make([]string, len(directives))
+	for i, line := range directives {
+		if strings.HasPrefix(strings.ToUpper(line), "#EXTGRP:") {
+			line = "#EXTGRP:" + group
+		}
+		copied[i] = line
+	}
+
+	return copied
+}
+
+// xtreamCategoriesAction is the categories action of a streams action.
+var xtreamCategoriesAction = map[string]string{
+	"get_live_streams": "get_live_categories",
+	"get_vod_streams":  "get_vod_categories",
+	"get_series":       "get_series_categories",
+}
+
+// filterXtreamResponse applies the filter rules, the user hidden categories
+// and the image proxy to a player_api.php response.
+// Responses are shared with the cache, they are copied before any change.
+func (c *Config) filterXtreamResponse(ctx *gin.Context, action string, resp interface{}) interface{} {
+	user := requestUser(ctx)
+
+	switch r := resp.(type) {
+	case []xtream.Category:
+		categories := make([]xtream.Category, 0, len(r))
+		for _, cat := range r {
+			name, ok := c.filterCategory(user, cat.Name)
+			if !ok {
+				continue
+			}
+			cat.Name = name
+			categories = append(categories, cat)
+		}
+		return categories
+
+	case []xtream.Stream:
+		names := c.xtreamCategoryNames(ctx, action)
+		streams := make([]xtream.Stream, 0, len(r))
+		for _, stream := range r {
+			category, ok := c.filterCategory(user, names[fmt.Sprint(stream.CategoryID)])
+			if !ok {
+				continue
+			}
+			name, ok := c.Filter.Name(stream.Name)
+			if !ok {
+				continue
+			}
+			stream.Name = name
+			if stream.CategoryName != "" {
+				stream.CategoryName = category
+			}
+			stream.Icon = c.imageURL(stream.Icon)
+			streams = append(streams, stream)
+		}
+		return streams
+
+	case []xtream.SeriesInfo:
+		names := c.xtreamCategoryNames(ctx, action)
+		series := make([]xtream.SeriesInfo, 0, len(r))
+		for _, serie := range r {
+			var catID string
+			if serie.CategoryID != nil {
+				catID = fmt.Sprint(*serie.CategoryID)
+			}
+			if _, ok := c.filterCategory(user, names[catID]); !ok {
+				continue
+			}
+			name, ok := c.Filter.Name(serie.Name)
+			if !ok {
+				continue
+			}
+			serie.Name = name
+			serie.Cover = c.imageURL(serie.Cover)
+			series = append(series, serie)
+		}
+		return series
+
+	case *xtream.VideoOnDemandInfo:
+		info := *r
+		info.Info.MovieImage = c.imageURL(info.Info.MovieImage)
+		if info.Info.BackdropPath != nil {
+			info.Info.BackdropPath = make([]string, len(r.Info.BackdropPath))
+			for i, backdrop := range r.Info.BackdropPath {
+				info.Info.BackdropPath[i] = c.imageURL(backdrop)
+			}
+		}
+		return &info
+
+	case *xtream.Series:
+		series := *r
+		series.Info.Cover = c.imageURL(series.Info.Cover)
+		series.Episodes = make(map[string][]xtream.SeriesEpisode, len(r.Episodes))
+		for season, episodes := range r.Episodes {
+			copied := make([]xtream.SeriesEpisode, len(episodes))
+			for i, episode := range episodes {
+				episode.Info.MovieImage = c.imageURL(episode.Info.MovieImage)
+				copied[i] = episode
+			}
+			series.Episodes[season] = copied
+		}
+		return &series
+	}
+
+	return resp
+}
+
+// filterCategory returns the renamed category, ok is false if it is hidden.
+func (c *Config) filterCategory(user *config.UserAccount, category string) (string, bool) {
+	name, ok := c.Filter.Group(category)
+	if !ok || user.Hides(category) || (name != category && user.Hides(name)) {
+		return "", false
+	}
+
+	return name, true
+}
+
+// xtreamCategoryNames returns the category names by id of a streams action.
+func (c *Config) xtreamCategoryNames(ctx *gin.Context, action string) map[string]string {
+	categoriesAction, ok := xtreamCategoriesAction[action]
+	if !ok {
+		return map[string]string{}
+	}
+
+	return c.xtreamAPI.CategoryNames(ctx.Request.Context(), ctx.Request.UserAgent(), categoriesAction)
+}
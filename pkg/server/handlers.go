@@ -21,10 +21,9 @@ package server
 import (
 	"bufio"
 	"bytes"
-	_ "embed"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"github.com/grafov/m3u8"
 	"io"
 	"log"
 	"net/http"
@@ -33,33 +32,53 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/buga1234/iptv-proxy/pkg/procgroup"
+	"github.com/buga1234/iptv-proxy/pkg/workdir"
+	"github.com/gin-gonic/gin"
+	"github.com/grafov/m3u8"
 )
 
-//go:embed fake.ts
-var fakeTS []byte
 var (
-	currentProcess   *FFmpegProcess
-	lastRequestTimer *time.Timer
-	timerMutex       sync.Mutex
+	currentProcess *FFmpegProcess
+	processMutex   sync.Mutex
 )
 
+// errTranscodingReplaced is returned when a concurrent request started
+// the transcoding of the same session.
+var errTranscodingReplaced = errors.New("transcoding replaced by another request")
+
 type FFmpegProcess struct {
 	Cmd      *exec.Cmd
 	LastPath string
+	// work directory session of the transcoding
+	Session string
 }
 
 func (c *Config) getM3U(ctx *gin.Context) {
+	if format := ctx.Query("format"); format != "" && format != "m3u" {
+		if !c.exportPlaylist(ctx, format) {
+			_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("unknown playlist format %q", format)) // nolint: errcheck
+		}
+		return
+	}
+
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
 	ctx.Header("Content-Type", "application/octet-stream")
 
-	ctx.File(c.proxyfiedM3UPath)
+	c.serveM3UFile(ctx, c.proxyfiedM3UPath)
 }
 
 func (c *Config) reverseProxy(ctx *gin.Context) {
+	if c.serveTrackCatchup(ctx, c.track) {
+		return
+	}
+
 	rpURL, err := url.Parse(c.track.URI)
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -68,41 +87,64 @@ func (c *Config) reverseProxy(ctx *gin.Context) {
 
 	c.stream(ctx, rpURL)
 }
+
+// hlsSegmentTTL is the validity of the transcoded segments URLs,
+// players reload the playlist well before.
+const hlsSegmentTTL = 5 * time.Minute
+
+// hlsSegmentURL returns the signed segments URLs of a transcoding session.
+func (c *Config) hlsSegmentURL(session string) func(name string) string {
+	expires := time.Now().Add(hlsSegmentTTL)
+
+	return func(name string) string {
+		token, _ := c.work.Sign(session, name, expires)
+		return fmt.Sprintf("/hlsdownloads/%s/stream/%s?expires=%d&token=%s", session, name, expires.Unix(), token)
+	}
+}
+
 func (c *Config) tsHandler(ctx *gin.Context) {
-	log.Println("tsHandler called")
-	streamID := ctx.Param("streamID")
+	streamID := filepath.Base(ctx.Param("streamID"))
 	tsID := ctx.Param("tsID")
-	// Путь к каталогу hlsdownloads
-	filePath := fmt.Sprintf("hlsdownloads/%s/stream/%s", tsID, streamID)
 
-	// Проверка существования файла
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// Если файла нет, отдаем фейковый файл
-		ctx.Data(http.StatusOK, "video/MP2T", fakeTS)
+	seconds, err := strconv.ParseInt(ctx.Query("expires"), 10, 64)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusForbidden, workdir.ErrInvalidToken) // nolint: errcheck
 		return
 	}
+	expires := time.Unix(seconds, 0)
 
-	// Отдаем реальный файл
+	err = c.work.Verify(tsID, streamID, ctx.Query("token"), expires)
+	switch {
+	case errors.Is(err, workdir.ErrClosed):
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	case err != nil:
+		_ = ctx.AbortWithError(http.StatusForbidden, err) // nolint: errcheck
+		return
+	case time.Now().After(expires):
+		_ = ctx.AbortWithError(http.StatusGone, errors.New("segment URL expired")) // nolint: errcheck
+		return
+	}
+
+	// ffmpeg removes the segments out of the playlist
+	dir, _ := c.work.Dir(tsID)
+	filePath := filepath.Join(dir, "stream", streamID)
+	if _, err := os.Stat(filePath); err != nil {
+		_ = ctx.AbortWithError(http.StatusGone, err) // nolint: errcheck
+		return
+	}
+
+	c.work.Touch(tsID)
+	ctx.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(time.Until(expires).Seconds())))
+	ctx.Header("Content-Type", "video/mp2t")
 	ctx.File(filePath)
 }
 
 func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
-	timerMutex.Lock()
-	if lastRequestTimer != nil {
-		lastRequestTimer.Stop()
-	}
-	lastRequestTimer = time.AfterFunc(1*time.Minute, func() {
-		if currentProcess != nil {
-			err := currentProcess.Cmd.Process.Kill()
-			if err != nil {
-				return
-			}
-			_, _ = currentProcess.Cmd.Process.Wait()
-			removeDirectoryFromPath(currentProcess.LastPath)
-			currentProcess = nil
-		}
-	})
-	timerMutex.Unlock()
+	if c.serveTrackCatchup(ctx, c.track) {
+		return
+	}
+
 	id := ctx.Param("id")
 	var idStream string
 
@@ -119,42 +161,35 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 		idStream = "0"
 	}
 
-	// Создание каталога, если он не существует
-	dirPath := fmt.Sprintf("hlsdownloads/%s/stream", idStream)
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		err = os.MkdirAll(dirPath, 0755)
-		if err != nil {
-			// Обработка ошибки
-			log.Fatal(err)
-		}
+	// the lock is only held to read or replace the current transcoding,
+	// not while it starts
+	processMutex.Lock()
+	// the transcoding is stopped by the work directory when not requested
+	if currentProcess != nil && !c.work.Touch(currentProcess.Session) {
+		currentProcess = nil
 	}
+	current := currentProcess
+	if current != nil && current.LastPath != rpURL.Path {
+		currentProcess = nil
+	}
+	processMutex.Unlock()
 
-	outputPath := fmt.Sprintf("%s/stream.m3u8", dirPath)
-
-	if currentProcess != nil {
-		if currentProcess.LastPath == rpURL.Path {
+	if current != nil {
+		if current.LastPath == rpURL.Path {
 			// Если путь не изменился, просто отдаем файл
-			ModifyAndSendPlaylist(ctx, outputPath)
+			sessionDir, _ := c.work.Dir(current.Session)
+			ModifyAndSendPlaylist(ctx, filepath.Join(sessionDir, "stream", "stream.m3u8"), c.hlsSegmentURL(current.Session))
 			return
-		} else {
-			// Если путь изменился, завершаем текущий процесс
-			if err := currentProcess.Cmd.Process.Kill(); err != nil {
-				// Обработка ошибки, например, запись в лог
-				log.Println("Failed to kill process:", err)
-			}
-			if _, err := currentProcess.Cmd.Process.Wait(); err != nil {
-				// Обработка ошибки, например, запись в лог
-				log.Println("Failed to wait for process:", err)
-			}
-
-			removeDirectoryFromPath(currentProcess.LastPath)
-			currentProcess = nil
 		}
+
+		// Если путь изменился, завершаем текущий процесс
+		c.work.Close(current.Session)
 	}
 
 	resp, err := http.Get(fullURL)
 	if err != nil {
-		log.Fatal(err)
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
@@ -162,7 +197,8 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 
 	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(resp.Body), true)
 	if err != nil {
-		log.Fatal(err)
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
 	}
 
 	var hlsTime, hlsListSize string
@@ -211,8 +247,25 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 	fmt.Println("BITRATE_AUDIO:", bitrateAudio)
 	fmt.Println("HLS_TIME:", hlsTime)
 	fmt.Println("HLS_LIST_SIZE:", hlsListSize)
+
+	// ffmpeg is killed with its session, even when closed before
+	// ffmpeg starts, and the directory is removed once it exited
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	exited := make(chan struct{})
+	sessionDir, err := c.work.Open(idStream, func() {
+		cancel()
+		<-exited
+	})
+	if err != nil {
+		cancel()
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+	dirPath := filepath.Join(sessionDir, "stream")
+	outputPath := filepath.Join(dirPath, "stream.m3u8")
+
 	// Запуск ffmpeg для трансляции
-	cmd := exec.Command("ffmpeg", "-i", fullURL,
+	cmd := procgroup.Command(sessionCtx, "ffmpeg", "-i", fullURL,
 		"-c:v", "libx264", "-preset", preset, "-tune", "zerolatency", "-crf", crf,
 		"-vf", "scale="+scale,
 		"-b:v", bitrateVideo,
@@ -226,10 +279,29 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 	cmd.Stdout = os.Stdout // Перенаправляем стандартный вывод
 	cmd.Stderr = os.Stderr // Перенаправляем стандартный вывод ошибок
 
-	err = cmd.Start()
+	err = os.MkdirAll(dirPath, 0755)
+	if err == nil {
+		err = procgroup.Start(cmd)
+	}
 	if err != nil {
-		log.Fatal(err)
+		if sessionCtx.Err() != nil {
+			err = errTranscodingReplaced
+		}
+		// the session is left to the idle sweep, it may be another
+		// request's by now
+		cancel()
+		close(exited)
+		if err == errTranscodingReplaced {
+			_ = ctx.AbortWithError(http.StatusServiceUnavailable, err) // nolint: errcheck
+			return
+		}
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
 	}
+	go func() {
+		_ = procgroup.Wait(cmd)
+		close(exited)
+	}()
 
 	maxAttempts := 60
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
@@ -237,40 +309,44 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 		if _, err := os.Stat(outputPath); os.IsNotExist(err) {
 			// Если файла нет и это не последняя попытка, ждем и пробуем снова
 			if attempt < maxAttempts {
-				time.Sleep(1 * time.Second)
-				continue
+				select {
+				case <-exited:
+				case <-time.After(1 * time.Second):
+					continue
+				}
 			}
-		} else {
-			// Если файл существует, выходим из цикла
-			break
+			if sessionCtx.Err() != nil {
+				_ = ctx.AbortWithError(http.StatusServiceUnavailable, errTranscodingReplaced) // nolint: errcheck
+				return
+			}
+			// ffmpeg exited or timed out
+			_ = ctx.AbortWithError(http.StatusBadGateway, errors.New("transcoding not started")) // nolint: errcheck
+			return
 		}
+		// Если файл существует, выходим из цикла
+		break
 	}
+
 	// Сохраняем информацию о текущем процессе
+	processMutex.Lock()
+	previous := currentProcess
 	currentProcess = &FFmpegProcess{
 		Cmd:      cmd,
 		LastPath: rpURL.Path,
+		Session:  idStream,
 	}
-	ModifyAndSendPlaylist(ctx, outputPath)
-}
-
-func removeDirectoryFromPath(path string) {
-	// Регулярное выражение для извлечения числа из строки
-	re := regexp.MustCompile(`/(\d+)/`)
-	matches := re.FindStringSubmatch(path)
-
-	if len(matches) > 1 {
-		id := matches[1]
-		dirPath := "hlsdownloads/" + id
-
-		// Удаление каталога
-		if err := os.RemoveAll(dirPath); err != nil {
-			// Обработка ошибки, например, запись в лог
-			log.Println("Failed to remove directory:", err)
-		}
+	processMutex.Unlock()
+	// started meanwhile by another request
+	if previous != nil && previous.Session != idStream {
+		c.work.Close(previous.Session)
 	}
+
+	ModifyAndSendPlaylist(ctx, outputPath, c.hlsSegmentURL(idStream))
 }
 
-func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string) {
+// ModifyAndSendPlaylist sends the ffmpeg playlist, segmentURL returns
+// the URLs of its segments.
+func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string, segmentURL func(name string) string) {
 	// Откройте файл для чтения
 	file, err := os.Open(outputPath)
 	if err != nil {
@@ -292,7 +368,7 @@ func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string) {
 		// Добавьте префикс "stream/" к URI каждого сегмента
 		for _, segment := range mediaList.Segments {
 			if segment != nil {
-				segment.URI = "/" + filepath.Dir(outputPath) + "/" + segment.URI
+				segment.URI = segmentURL(segment.URI)
 
 			}
 		}
@@ -301,22 +377,118 @@ func ModifyAndSendPlaylist(ctx *gin.Context, outputPath string) {
 		modifiedPlaylist := mediaList.Encode().Bytes()
 
 		// Отправьте новый плейлист пользователю
+		ctx.Header("Cache-Control", "no-cache")
 		ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", modifiedPlaylist)
 	}
 }
 
-func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
-	client := &http.Client{}
+var errStreamLimit = errors.New("stream limit reached")
+
+// upstreamBody releases the stream slot when closed.
+type upstreamBody struct {
+	io.ReadCloser
+	streams *streamLimiter
+	once    sync.Once
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.streams.detach(b)
+	})
+
+	return err
+}
 
-	req, err := http.NewRequest("GET", oriURL.String(), nil)
+// openStream requests an upstream stream within the stream limit,
+// the slot is released when the response body is closed.
+func (c *Config) openStream(ctx context.Context, oriURL *url.URL, header http.Header) (*http.Response, error) {
+	if !c.streams.acquire() {
+		return nil, errStreamLimit
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oriURL.String(), nil)
 	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+		c.streams.release()
+		return nil, err
 	}
+	mergeHttpHeader(req.Header, header)
 
-	mergeHttpHeader(req.Header, ctx.Request.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.streams.release()
+		return nil, err
+	}
+	body := &upstreamBody{ReadCloser: resp.Body, streams: c.streams}
+	c.streams.attach(body)
+	resp.Body = body
+
+	return resp, nil
+}
 
-	resp, err := client.Do(req)
+// openLive opens the MPEG-TS stream of a live channel within the stream
+// limit, HLS channels are remuxed by ffmpeg.
+func (c *Config) openLive(ctx context.Context, oriURL *url.URL) (io.ReadCloser, error) {
+	if strings.HasSuffix(oriURL.Path, ".m3u8") {
+		return c.openLiveHLS(ctx, oriURL)
+	}
+
+	resp, err := c.openStream(ctx, oriURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", oriURL.Redacted(), resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// ffmpegStream is the output of an ffmpeg process, killed when closed.
+type ffmpegStream struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	streams *streamLimiter
+	once    sync.Once
+}
+
+func (s *ffmpegStream) Close() error {
+	s.once.Do(func() {
+		_ = procgroup.Kill(s.cmd)
+		_ = procgroup.Wait(s.cmd)
+		s.streams.detach(s)
+	})
+
+	return nil
+}
+
+func (c *Config) openLiveHLS(ctx context.Context, oriURL *url.URL) (io.ReadCloser, error) {
+	if !c.streams.acquire() {
+		return nil, errStreamLimit
+	}
+
+	cmd := procgroup.Command(ctx, "ffmpeg", "-loglevel", "error", "-i", oriURL.String(), "-c", "copy", "-f", "mpegts", "pipe:1")
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = procgroup.Start(cmd)
+	}
+	if err != nil {
+		c.streams.release()
+		return nil, err
+	}
+	s := &ffmpegStream{ReadCloser: out, cmd: cmd, streams: c.streams}
+	c.streams.attach(s)
+
+	return s, nil
+}
+
+func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
+	resp, err := c.openStream(ctx.Request.Context(), oriURL, ctx.Request.Header)
+	if errors.Is(err, errStreamLimit) {
+		_ = ctx.AbortWithError(http.StatusServiceUnavailable, err) // nolint: errcheck
+		return
+	}
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -372,15 +544,33 @@ type authRequest struct {
 	Password string `form:"password" binding:"required"`
 }
 
+// credentials returns the user matching the credentials. The secret
+// standing for a hashed password is only accepted by the stream routes,
+// see streamCredentials.
+func (c *Config) credentials(username, password string) (*config.UserAccount, bool) {
+	return c.Users.Authenticate(username, password)
+}
+
 func (c *Config) authenticate(ctx *gin.Context) {
 	var authReq authRequest
 	if err := ctx.Bind(&authReq); err != nil {
 		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
 		return
 	}
-	if c.ProxyConfig.User.String() != authReq.Username || c.ProxyConfig.Password.String() != authReq.Password {
+	if !c.admit(ctx, authReq.Username) {
+		return
+	}
+	user, ok := c.credentials(authReq.Username, authReq.Password)
+	if !ok {
+		c.authFailed(ctx, authReq.Username)
 		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
 	}
+	c.authSucceeded(ctx, authReq.Username)
+	if !c.userAllowed(ctx, user) {
+		return
+	}
+	ctx.Set(userContextKey, user)
 }
 
 func (c *Config) appAuthenticate(ctx *gin.Context) {
@@ -400,9 +590,20 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 		return
 	}
 	log.Printf("[iptv-proxy] %v | %s |App Auth\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-	if c.ProxyConfig.User.String() != q["username"][0] || c.ProxyConfig.Password.String() != q["password"][0] {
+	if !c.admit(ctx, q["username"][0]) {
+		return
+	}
+	user, ok := c.credentials(q["username"][0], q["password"][0])
+	if !ok {
+		c.authFailed(ctx, q["username"][0])
 		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.authSucceeded(ctx, q["username"][0])
+	if !c.userAllowed(ctx, user) {
+		return
 	}
+	ctx.Set(userContextKey, user)
 
 	ctx.Request.Body = io.NopCloser(bytes.NewReader(contents))
 }
@@ -0,0 +1,278 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/ssdp"
+	"github.com/gin-gonic/gin"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// HDHomeRun tuner emulation, for Plex, Jellyfin and Emby live TV.
+
+// tuner count advertised when there is no stream limit
+const defaultTunerCount = 4
+
+type hdhrDiscover struct {
+	FriendlyName    string
+	Manufacturer    string
+	ModelNumber     string
+	FirmwareName    string
+	FirmwareVersion string
+	DeviceID        string
+	DeviceAuth      string
+	TunerCount      int
+	BaseURL         string
+	LineupURL       string
+}
+
+type hdhrLineupStatus struct {
+	ScanInProgress int
+	ScanPossible   int
+	Source         string
+	SourceList     []string
+}
+
+type hdhrChannel struct {
+	GuideNumber string
+	GuideName   string
+	URL         string
+	HD          int `json:",omitempty"`
+}
+
+type hdhrDeviceXML struct {
+	XMLName     xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		DeviceType   string `xml:"deviceType"`
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+		ModelNumber  string `xml:"modelNumber"`
+		SerialNumber string `xml:"serialNumber"`
+		UDN          string `xml:"UDN"`
+	} `xml:"device"`
+}
+
+func (c *Config) hdhrRoutes(r *gin.RouterGroup) {
+	if !c.HDHomeRun {
+		return
+	}
+
+	// Media servers can't authenticate on a tuner: it is only reachable
+	// from the local network, and its lineup URLs are signed.
+	r.GET("/discover.json", c.localNetwork, c.hdhrDiscover)
+	r.GET("/lineup_status.json", c.localNetwork, c.hdhrLineupStatus)
+	r.GET("/lineup.json", c.localNetwork, c.hdhrLineup)
+	r.POST("/lineup.post", c.localNetwork, c.hdhrLineupPost)
+	r.GET("/device.xml", c.localNetwork, c.hdhrDeviceXML)
+}
+
+// hdhrDeviceID returns the configured device id, or one derived from the hostname.
+func (c *Config) hdhrDeviceID() string {
+	if c.HDHomeRunDeviceID != "" {
+		return c.HDHomeRunDeviceID
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(c.HostConfig.Hostname + strconv.Itoa(c.AdvertisedPort)))
+
+	return fmt.Sprintf("%08X", h.Sum32())
+}
+
+func (c *Config) hdhrTunerCount() int {
+	if c.StreamLimit > 0 {
+		return c.StreamLimit
+	}
+
+	return defaultTunerCount
+}
+
+func (c *Config) hdhrDiscover(ctx *gin.Context) {
+	baseURL := c.advertisedURL("")
+
+	ctx.JSON(http.StatusOK, hdhrDiscover{
+		FriendlyName:    "iptv-proxy",
+		Manufacturer:    "Silicondust",
+		ModelNumber:     "HDTC-2US",
+		FirmwareName:    "hdhomeruntc_atsc",
+		FirmwareVersion: "20150826",
+		DeviceID:        c.hdhrDeviceID(),
+		DeviceAuth:      "iptv-proxy",
+		TunerCount:      c.hdhrTunerCount(),
+		BaseURL:         baseURL,
+		LineupURL:       baseURL + "/lineup.json",
+	})
+}
+
+func (c *Config) hdhrLineupStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, hdhrLineupStatus{
+		ScanPossible: 1,
+		Source:       "Cable",
+		SourceList:   []string{"Cable"},
+	})
+}
+
+func (c *Config) hdhrLineupPost(ctx *gin.Context) {
+	ctx.Status(http.StatusOK)
+}
+
+// hdhrLineup lists the channels, from the Xtream backend live streams if
+// there is one, from the proxified playlist otherwise.
+func (c *Config) hdhrLineup(ctx *gin.Context) {
+	var lineup []hdhrChannel
+	if c.XtreamBaseURL != "" {
+		var err error
+		if lineup, err = c.hdhrXtreamLineup(ctx); err != nil {
+			_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+			return
+		}
+	} else {
+		lineup = c.hdhrPlaylistLineup()
+	}
+
+	user := c.mainUser()
+	if user == nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, errors.New("no proxy user")) // nolint: errcheck
+		return
+	}
+	// media servers keep the lineup, its URLs don't expire
+	sign := c.signerUntil(ctx, user, 0)
+	for i := range lineup {
+		lineup[i].URL = sign(lineup[i].URL)
+	}
+
+	ctx.JSON(http.StatusOK, lineup)
+}
+
+func (c *Config) hdhrPlaylistLineup() []hdhrChannel {
+	lineup := make([]hdhrChannel, 0, len(c.playlist.Tracks))
+	for i := range c.playlist.Tracks {
+		track := &c.playlist.Tracks[i]
+
+		uri, err := c.replaceURL(track.URI, i, false)
+		if err != nil {
+			log.Printf("ERROR: track: %s: %s", track.Name, err)
+			continue
+		}
+
+		number := track.Tag("tvg-chno")
+		if number == "" {
+			number = strconv.Itoa(i + 1)
+		}
+
+		lineup = append(lineup, hdhrChannel{
+			GuideNumber: number,
+			GuideName:   track.Name,
+			URL:         uri,
+			HD:          hdhrHD(track.Name),
+		})
+	}
+
+	return lineup
+}
+
+func (c *Config) hdhrXtreamLineup(ctx *gin.Context) ([]hdhrChannel, error) {
+	resp, _, err := c.xtreamAPI.Action(ctx.Request.Context(), ctx.Request.UserAgent(), "get_live_streams", nil)
+	if err != nil {
+		return nil, err
+	}
+	streams, _ := c.filterXtreamResponse(ctx, "get_live_streams", resp).([]xtream.Stream)
+
+	lineup := make([]hdhrChannel, 0, len(streams))
+	for i, stream := range streams {
+		if excludedTrackRegexp.MatchString(stream.Name) {
+			continue
+		}
+
+		number := strconv.Itoa(int(stream.Number))
+		if stream.Number == 0 {
+			number = strconv.Itoa(i + 1)
+		}
+
+		lineup = append(lineup, hdhrChannel{
+			GuideNumber: number,
+			GuideName:   stream.Name,
+			URL:         c.advertisedURL(fmt.Sprintf("/live/%s/%s/%d.ts", c.User.PathEscape(), c.Password.PathEscape(), stream.ID)),
+			HD:          hdhrHD(stream.Name),
+		})
+	}
+
+	return lineup, nil
+}
+
+func hdhrHD(name string) int {
+	if strings.Contains(strings.ToUpper(name), "HD") {
+		return 1
+	}
+
+	return 0
+}
+
+func (c *Config) hdhrDeviceXML(ctx *gin.Context) {
+	var d hdhrDeviceXML
+	d.SpecVersion.Major = 1
+	d.URLBase = c.advertisedURL("")
+	d.Device.DeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	d.Device.FriendlyName = "iptv-proxy"
+	d.Device.Manufacturer = "Silicondust"
+	d.Device.ModelName = "HDTC-2US"
+	d.Device.ModelNumber = "HDTC-2US"
+	d.Device.SerialNumber = c.hdhrDeviceID()
+	d.Device.UDN = "uuid:" + c.hdhrUUID()
+
+	ctx.XML(http.StatusOK, d)
+}
+
+// hdhrUUID returns an UPnP uuid built from the device id.
+func (c *Config) hdhrUUID() string {
+	return fmt.Sprintf("%s-0000-0000-0000-000000000000", strings.ToLower(c.hdhrDeviceID()))
+}
+
+// hdhrAnnounce announces the tuner on the LAN with SSDP, until ctx is done.
+func (c *Config) hdhrAnnounce(ctx context.Context) {
+	if !c.HDHomeRun || !c.HDHomeRunSSDP {
+		return
+	}
+
+	d := &ssdp.Device{
+		Location: c.advertisedURL("/device.xml"),
+		UUID:     c.hdhrUUID(),
+		Types:    []string{"urn:schemas-upnp-org:device:MediaServer:1"},
+	}
+
+	if err := ssdp.Announce(ctx, d); err != nil {
+		log.Printf("[iptv-proxy] %v | SSDP announcement stopped: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+	}
+}
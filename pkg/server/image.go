@@ -0,0 +1,124 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/gin-gonic/gin"
+)
+
+// Logos and posters proxy, the images are cached on disk.
+// Image URLs are signed, the proxy only fetches the images it published.
+
+func (c *Config) imageRoutes(r *gin.RouterGroup) {
+	if !c.ImageProxy {
+		return
+	}
+
+	// Players load images without credentials.
+	r.GET("/img/:sig/:src", c.serveImage)
+}
+
+func (c *Config) imageSignature(src string) string {
+	key := sha256.Sum256([]byte("iptv-proxy image " + c.User.String() + ":" + c.Password.String()))
+	mac := hmac.New(sha256.New, key[:])
+	_, _ = mac.Write([]byte(src))
+
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// imageURL returns the proxified URL of an image, or src when the proxy is off.
+func (c *Config) imageURL(src string) string {
+	if !c.ImageProxy || (!strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://")) {
+		return src
+	}
+
+	return c.advertisedURL(fmt.Sprintf("/img/%s/%s", c.imageSignature(src), base64.RawURLEncoding.EncodeToString([]byte(src))))
+}
+
+// imageSource returns the original URL of a proxified image.
+func (c *Config) imageSource(ctx *gin.Context) (string, error) {
+	src, err := base64.RawURLEncoding.DecodeString(ctx.Param("src"))
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(c.imageSignature(string(src))), []byte(ctx.Param("sig"))) {
+		return "", errors.New("invalid image signature")
+	}
+
+	return string(src), nil
+}
+
+func (c *Config) serveImage(ctx *gin.Context) {
+	src, err := c.imageSource(ctx)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+
+	path, err := c.images.Get(ctx.Request.Context(), src)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Header("Cache-Control", "public, max-age=86400")
+	// images come from anywhere and are served same-origin: SVG scripts
+	// must not run if one is opened, nor any content be sniffed as HTML
+	ctx.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	ctx.Header("X-Content-Type-Options", "nosniff")
+	ctx.File(path)
+}
+
+// imageTags returns the tags with the tvg-logo proxified,
+// the tags are copied when changed.
+func (c *Config) imageTags(tags []m3u.Tag) []m3u.Tag {
+	if !c.ImageProxy {
+		return tags
+	}
+
+	var copied []m3u.Tag
+	for i, tag := range tags {
+		if !strings.EqualFold(tag.Name, "tvg-logo") {
+			continue
+		}
+		logo := c.imageURL(tag.Value)
+		if logo == tag.Value {
+			continue
+		}
+		if copied == nil {
+			copied = append([]m3u.Tag(nil), tags...)
+		}
+		copied[i].Value = logo
+	}
+	if copied == nil {
+		return tags
+	}
+
+	return copied
+}
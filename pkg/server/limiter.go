@@ -0,0 +1,105 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// streamLimiter caps the number of concurrent upstream streams.
+// A zero limit means unlimited.
+type streamLimiter struct {
+	lock     sync.Mutex
+	limit    int
+	active   int
+	open     map[io.Closer]struct{}
+	draining bool
+}
+
+func newStreamLimiter(limit int) *streamLimiter {
+	return &streamLimiter{limit: limit, open: make(map[io.Closer]struct{})}
+}
+
+// acquire reserves a stream slot, it returns false if the limit is
+// reached or the streams are drained.
+func (l *streamLimiter) acquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.draining || l.limit > 0 && l.active >= l.limit {
+		return false
+	}
+	l.active++
+
+	return true
+}
+
+// release frees a slot reserved with acquire.
+func (l *streamLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.active > 0 {
+		l.active--
+	}
+}
+
+// attach tracks the stream of an acquired slot, until detach.
+func (l *streamLimiter) attach(s io.Closer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.open[s] = struct{}{}
+}
+
+// detach forgets a stream and frees its slot.
+func (l *streamLimiter) detach(s io.Closer) {
+	l.lock.Lock()
+	delete(l.open, s)
+	l.lock.Unlock()
+
+	l.release()
+}
+
+// drain refuses the new streams and closes the open ones, returning
+// their number.
+func (l *streamLimiter) drain() int {
+	l.lock.Lock()
+	l.draining = true
+	open := make([]io.Closer, 0, len(l.open))
+	for s := range l.open {
+		open = append(open, s)
+	}
+	l.lock.Unlock()
+
+	for _, s := range open {
+		_ = s.Close()
+	}
+
+	return len(open)
+}
+
+// inUse returns the number of active streams.
+func (l *streamLimiter) inUse() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.active
+}
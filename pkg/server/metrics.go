@@ -0,0 +1,66 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metrics are the counters served on /metrics, in the Prometheus text format.
+type metrics struct {
+	authFailures atomic.Int64
+	lockouts     atomic.Int64
+	lockedOut    atomic.Int64
+	rateLimited  atomic.Int64
+}
+
+func (c *Config) metricsRoutes(r *gin.RouterGroup) {
+	if !c.Metrics {
+		return
+	}
+
+	// scrapers don't authenticate, the counters stay on the local network
+	r.GET("/metrics", c.localNetwork, c.serveMetrics)
+}
+
+func (c *Config) serveMetrics(ctx *gin.Context) {
+	var lockedIPs, lockedUsers int
+	if c.ipLockout != nil {
+		lockedIPs, lockedUsers = c.ipLockout.Count(), c.userLockout.Count()
+	}
+
+	ctx.Status(http.StatusOK)
+	ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := ctx.Writer
+	writeMetric(w, "iptv_proxy_auth_failures_total", "counter", "Failed authentications.", c.metrics.authFailures.Load())
+	writeMetric(w, "iptv_proxy_lockouts_total", "counter", "Clients locked out after failed authentications.", c.metrics.lockouts.Load())
+	writeMetric(w, "iptv_proxy_locked_out_requests_total", "counter", "Requests refused to locked out clients.", c.metrics.lockedOut.Load())
+	writeMetric(w, "iptv_proxy_rate_limited_requests_total", "counter", "Requests refused by the rate limit.", c.metrics.rateLimited.Load())
+	writeMetric(w, "iptv_proxy_locked_ips", "gauge", "IP addresses locked out.", int64(lockedIPs))
+	writeMetric(w, "iptv_proxy_locked_users", "gauge", "Usernames locked out.", int64(lockedUsers))
+	writeMetric(w, "iptv_proxy_active_streams", "gauge", "Active upstream streams.", int64(c.streams.inUse()))
+}
+
+func writeMetric(w gin.ResponseWriter, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,139 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// The playlist and API requests are rate limited per client IP, and the
+// clients failing to authenticate are locked out, per IP and per username.
+// The username lockout doesn't apply to the IPs which authenticated as the
+// user, so it can't be used to lock a user out of its own devices.
+
+// knownClientTTL is how long a client which authenticated is exempt from
+// the username lockout.
+const knownClientTTL = 7 * 24 * time.Hour
+
+// newRateLimits creates the rate limiter and the lockouts, left nil
+// when disabled.
+func (c *Config) newRateLimits() {
+	if c.RateLimit > 0 {
+		c.limiter = ratelimit.NewLimiter(c.RateLimit, c.RateLimitBurst)
+	}
+	if c.AuthMaxFailures > 0 {
+		base := time.Duration(c.AuthLockout) * time.Minute
+		max := time.Duration(c.AuthLockoutMax) * time.Minute
+		if max < base {
+			max = base
+		}
+		c.ipLockout = ratelimit.NewLockout(c.AuthMaxFailures, base, max)
+		c.userLockout = ratelimit.NewLockout(c.AuthMaxFailures, base, max)
+		c.knownClients = ratelimit.NewKnown(knownClientTTL)
+	}
+}
+
+// admit applies the rate limit and the lockouts to an authentication
+// request, it is aborted when refused.
+func (c *Config) admit(ctx *gin.Context, username string) bool {
+	if trustedDevice(ctx) {
+		return true
+	}
+	if c.limiter != nil {
+		if ok, wait := c.limiter.Allow(ctx.ClientIP()); !ok {
+			c.metrics.rateLimited.Add(1)
+			tooManyRequests(ctx, wait)
+			return false
+		}
+	}
+
+	return !c.lockedOut(ctx, username)
+}
+
+// lockedOut aborts the requests of the locked out clients.
+func (c *Config) lockedOut(ctx *gin.Context, username string) bool {
+	if c.ipLockout == nil || trustedDevice(ctx) {
+		return false
+	}
+
+	wait := c.ipLockout.Locked(ctx.ClientIP())
+	if username != "" && !c.knownClient(ctx, username) {
+		if w := c.userLockout.Locked(username); w > wait {
+			wait = w
+		}
+	}
+	if wait == 0 {
+		return false
+	}
+
+	c.metrics.lockedOut.Add(1)
+	tooManyRequests(ctx, wait)
+
+	return true
+}
+
+// authFailed counts a failed authentication, username is "" when the
+// client has no username.
+func (c *Config) authFailed(ctx *gin.Context, username string) {
+	c.metrics.authFailures.Add(1)
+	if c.ipLockout == nil {
+		return
+	}
+
+	ip := ctx.ClientIP()
+	lockout := c.ipLockout.Fail(ip)
+	if username != "" && !c.knownClient(ctx, username) {
+		if l := c.userLockout.Fail(username); l > lockout {
+			lockout = l
+		}
+	}
+	if lockout > 0 {
+		c.metrics.lockouts.Add(1)
+		log.Printf("[iptv-proxy] %v | %s |Locked out for %v after failed authentications (user %q)\n", time.Now().Format("2006/01/02 - 15:04:05"), ip, lockout, username)
+	}
+}
+
+// authSucceeded forgets the failures of a client IP, which is no longer
+// locked out with the username. The username failures are kept, they may
+// come from other clients.
+func (c *Config) authSucceeded(ctx *gin.Context, username string) {
+	if c.ipLockout == nil {
+		return
+	}
+
+	c.ipLockout.Succeed(ctx.ClientIP())
+	c.knownClients.Add(username + "\n" + ctx.ClientIP())
+}
+
+// knownClient reports whether the client IP authenticated as username.
+func (c *Config) knownClient(ctx *gin.Context, username string) bool {
+	return c.knownClients.Contains(username + "\n" + ctx.ClientIP())
+}
+
+func tooManyRequests(ctx *gin.Context, wait time.Duration) {
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	ctx.AbortWithStatus(http.StatusTooManyRequests)
+}
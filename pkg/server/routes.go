@@ -28,6 +28,13 @@ import (
 
 func (c *Config) routes(r *gin.RouterGroup) {
 	r = r.Group(c.CustomEndpoint)
+	c.metricsRoutes(r)
+	c.epgRoutes(r)
+	c.imageRoutes(r)
+	c.dvrRoutes(r)
+	c.timeshiftRoutes(r)
+	c.hdhrRoutes(r)
+	c.stalkerRoutes(r)
 	//Xtream service endopoints
 	if c.ProxyConfig.XtreamBaseURL != "" {
 		c.xtreamRoutes(r)
@@ -47,6 +54,11 @@ func (c *Config) routes(r *gin.RouterGroup) {
 	r.GET("/hlsdownloads/:tsID/stream/:streamID", c.tsHandler)
 	c.m3uRoutes(r)
 
+	// Xtream service emulated on top of the m3u playlist
+	if c.ProxyConfig.XtreamBaseURL == "" && c.XtreamEmulation {
+		c.localXtreamRoutes(r)
+	}
+
 }
 
 func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
@@ -60,12 +72,12 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
 	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
 	r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
-	r.GET(fmt.Sprintf("/%s/%s/:id", c.User, c.Password), c.xtreamStreamHandler)
-	r.GET(fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), c.xtreamStreamLive)
-	r.GET(fmt.Sprintf("/timeshift/%s/%s/:duration/:start/:id", c.User, c.Password), c.xtreamStreamTimeshift)
-	r.GET(fmt.Sprintf("/movie/%s/%s/:id", c.User, c.Password), c.xtreamStreamMovie)
-	r.GET(fmt.Sprintf("/series/%s/%s/:id", c.User, c.Password), c.xtreamStreamSeries)
-	r.GET(fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
+	c.streamRoute(r, "/%s/%s/:id", c.xtreamStreamHandler)
+	c.streamRoute(r, "/live/%s/%s/:id", c.xtreamStreamLive)
+	c.streamRoute(r, "/timeshift/%s/%s/:duration/:start/:id", c.xtreamStreamTimeshift)
+	c.streamRoute(r, "/movie/%s/%s/:id", c.xtreamStreamMovie)
+	c.streamRoute(r, "/series/%s/%s/:id", c.xtreamStreamSeries)
+	c.streamRoute(r, "/hlsr/:hlsrToken/%s/%s/:channel/:hash/:chunk", c.xtreamHlsrStream)
 	r.GET("/hls/:token/:chunk", c.xtreamHlsStream)
 	r.GET("/play/:token/:type", c.xtreamStreamPlay)
 }
@@ -74,17 +86,16 @@ func (c *Config) m3uRoutes(r *gin.RouterGroup) {
 	r.GET("/"+c.M3UFileName, c.authenticate, c.getM3U)
 	// XXX Private need: for external Android app
 	r.POST("/"+c.M3UFileName, c.authenticate, c.getM3U)
+	c.streamRoute(r, "/catchup/%s/%s/:ref", c.archiveProxy)
 
 	for i, track := range c.playlist.Tracks {
-		trackConfig := &Config{
-			ProxyConfig: c.ProxyConfig,
-			track:       &c.playlist.Tracks[i],
-		}
+		trackConfig := *c
+		trackConfig.track = &c.playlist.Tracks[i]
 
 		if strings.HasSuffix(track.URI, ".m3u8") {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/:id", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3u8ReverseProxy)
+			c.streamRoute(r, fmt.Sprintf("/%s/%%s/%%s/%d/:id", c.endpointAntiColision, i), trackConfig.m3u8ReverseProxy)
 		} else {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/%s", c.endpointAntiColision, c.User, c.Password, i, path.Base(track.URI)), trackConfig.reverseProxy)
+			c.streamRoute(r, fmt.Sprintf("/%s/%%s/%%s/%d/%s", c.endpointAntiColision, i, strings.ReplaceAll(path.Base(track.URI), "%", "%%")), trackConfig.reverseProxy)
 		}
 
 	}
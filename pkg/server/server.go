@@ -19,25 +19,42 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"github.com/buga1234/iptv-proxy/pkg/access"
 	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/buga1234/iptv-proxy/pkg/dvr"
+	"github.com/buga1234/iptv-proxy/pkg/epg"
+	"github.com/buga1234/iptv-proxy/pkg/imgcache"
 	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/buga1234/iptv-proxy/pkg/procgroup"
+	"github.com/buga1234/iptv-proxy/pkg/ratelimit"
+	"github.com/buga1234/iptv-proxy/pkg/timeshift"
+	"github.com/buga1234/iptv-proxy/pkg/tlsconfig"
+	"github.com/buga1234/iptv-proxy/pkg/vodcache"
+	"github.com/buga1234/iptv-proxy/pkg/workdir"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	uuid "github.com/satori/go.uuid"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
 var endpointAntiColision = "a6d7e846"
 
+// tracks matching this expression are not published
+var excludedTrackRegexp = regexp.MustCompile(`FHD|\+|orig| 4K`)
+
 // Config represent the server configuration
 type Config struct {
 	*config.ProxyConfig
@@ -50,44 +67,253 @@ type Config struct {
 	proxyfiedM3UPath string
 
 	endpointAntiColision string
+
+	// EPG cache, nil when there is no guide source
+	epg *epg.Cache
+
+	// concurrent upstream streams
+	streams *streamLimiter
+
+	// player_api.php cache, nil without xtream backend
+	xtreamAPI *xtreamAPICache
+
+	// logos and posters, nil without image proxy
+	images *imgcache.Cache
+
+	// movies and episodes, nil without VOD cache
+	vod *vodcache.Cache
+
+	// recordings, nil without DVR
+	dvr *dvr.DVR
+
+	// HLS transcodings and timeshift buffers sessions
+	work *workdir.Manager
+
+	// live channels buffers, nil without timeshift
+	timeshift *timeshift.Buffers
+
+	// timezone of the playlist catch-up URLs
+	catchupLocation *time.Location
+	// key of the HLS archive URLs, encrypted as they hold provider credentials
+	catchupKey []byte
+
+	// playlist and API requests rate, nil without limit
+	limiter *ratelimit.Limiter
+	// failed authentications, nil without lockout
+	ipLockout, userLockout *ratelimit.Lockout
+	// "<username>\n<ip>" of the clients which authenticated, not
+	// locked out with the username
+	knownClients *ratelimit.Known
+	metrics      *metrics
+
+	// clients rules, nil without any
+	access     *access.Rules
+	userAccess map[string]*access.Rules
+	// clients countries, nil without database
+	geoip *access.GeoIP
+
+	// certificates, nil without TLS
+	tls *tlsconfig.Reloader
 }
 
 // NewServer initialize a new server configuration
 func NewServer(config *config.ProxyConfig) (*Config, error) {
 	var p m3u.Playlist
 	if config.RemoteURL.String() != "" {
+		var tracks []m3u.Track
 		var err error
-		p, err = m3u.Parse(config.RemoteURL.String())
+		filter := &Config{ProxyConfig: config}
+		p, err = m3u.ParseContext(context.Background(), config.RemoteURL.String(), func(track m3u.Track) error {
+			// don't keep what won't be published, lists can be huge
+			if filter.filterTrack(&track) {
+				tracks = append(tracks, track)
+			}
+			return nil
+		})
 		if err != nil {
 			return nil, err
 		}
+		p.Tracks = tracks
 	}
 
+	config.Password = urlPassword(config.Password)
+
 	if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
 		endpointAntiColision = trimmedCustomId
 	}
 
-	return &Config{
-		config,
-		&p,
-		nil,
-		defaultProxyfiedM3UPath,
-		endpointAntiColision,
-	}, nil
+	c := &Config{
+		ProxyConfig:          config,
+		playlist:             &p,
+		proxyfiedM3UPath:     defaultProxyfiedM3UPath,
+		endpointAntiColision: endpointAntiColision,
+		streams:              newStreamLimiter(config.StreamLimit),
+		metrics:              &metrics{},
+	}
+	c.newRateLimits()
+	if err := c.newAccessRules(); err != nil {
+		return nil, err
+	}
+	if err := c.newCatchup(); err != nil {
+		return nil, err
+	}
+	if config.TLSCert != "" {
+		var err error
+		if c.tls, err = tlsconfig.New(config.TLSCert, config.TLSKey, config.TLSClientCA, config.TLSRequireClientCert); err != nil {
+			return nil, err
+		}
+	}
+	c.epg = c.newEPGCache()
+	if config.XtreamBaseURL != "" {
+		c.xtreamAPI = newXtreamAPICache(config)
+	}
+	if config.ImageProxy {
+		var err error
+		if c.images, err = imgcache.New(config.ImageCacheDir, int64(config.ImageCacheSize)<<20, config.ImageSize); err != nil {
+			return nil, err
+		}
+	}
+	if config.VODCache && config.XtreamBaseURL != "" {
+		var err error
+		if c.vod, err = vodcache.New(config.VODCacheDir, int64(config.VODCacheSize)<<30); err != nil {
+			return nil, err
+		}
+	}
+	if config.DVR {
+		var err error
+		if c.dvr, err = c.newDVR(); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if c.work, err = workdir.New(config.WorkDir, int64(config.WorkDirQuota)<<20, time.Duration(config.WorkIdleTimeout)*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.Timeshift > 0 {
+		c.timeshift = timeshift.New(c.work, time.Duration(config.Timeshift)*time.Minute, c.timeshiftOpen)
+	}
+
+	return c, nil
+}
+
+// urlPassword returns the password of the proxy URLs: a hashed main
+// password can't be in the URLs, a secret derived from it is.
+func urlPassword(password config.CredentialString) config.CredentialString {
+	if !config.IsPasswordHash(password.String()) {
+		return password
+	}
+
+	return config.CredentialString(config.PasswordSecret(password.String()))
 }
 
-// Serve the iptv-proxy api
-func (c *Config) Serve() error {
+// Serve the iptv-proxy api until ctx is done, then shut it down.
+func (c *Config) Serve(ctx context.Context) error {
+	defer c.removeTempFiles()
 	if err := c.playlistInitialization(); err != nil {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var runners sync.WaitGroup
+	run := func(f func(context.Context)) {
+		runners.Add(1)
+		go func() {
+			defer runners.Done()
+			f(ctx)
+		}()
+	}
+
+	if c.epg != nil {
+		run(c.epg.Run)
+	}
+	if c.dvr != nil {
+		run(c.dvr.Run)
+	}
+	run(c.work.Run)
+	if c.limiter != nil {
+		run(c.limiter.Run)
+	}
+	if c.ipLockout != nil {
+		run(c.ipLockout.Run)
+		run(c.userLockout.Run)
+		run(c.knownClients.Run)
+	}
+	run(c.hdhrAnnounce)
+
 	router := gin.Default()
+	// X-Forwarded-For is only trusted from the reverse proxies
+	if err := router.SetTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
 	router.Use(cors.Default())
+	router.Use(c.accessControl)
 	group := router.Group("/")
 	c.routes(group)
 
-	return router.Run(fmt.Sprintf(":%d", c.HostConfig.Port))
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", c.HostConfig.Port), Handler: router.Handler()}
+	var redirect *http.Server
+	served := make(chan error, 1)
+	if c.tls == nil {
+		log.Printf("[iptv-proxy] %v | Listening and serving HTTP on %s\n", time.Now().Format("2006/01/02 - 15:04:05"), srv.Addr)
+		go func() {
+			served <- srv.ListenAndServe()
+		}()
+	} else {
+		run(c.tls.Run)
+		if c.HTTPRedirectPort > 0 {
+			redirect = c.redirectHTTPS()
+		}
+		log.Printf("[iptv-proxy] %v | Listening and serving HTTPS on %s\n", time.Now().Format("2006/01/02 - 15:04:05"), srv.Addr)
+		srv.TLSConfig = c.tls.Config()
+		go func() {
+			served <- srv.ListenAndServeTLS("", "")
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		log.Printf("[iptv-proxy] %v | Shutting down\n", time.Now().Format("2006/01/02 - 15:04:05"))
+	}
+	cancel()
+
+	// the live streams never end by themselves
+	if n := c.streams.drain(); n > 0 {
+		log.Printf("[iptv-proxy] %v | Closed %d live streams\n", time.Now().Format("2006/01/02 - 15:04:05"), n)
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(c.ShutdownTimeout)*time.Second)
+	defer cancelShutdown()
+	if e := srv.Shutdown(shutdownCtx); e != nil {
+		log.Printf("[iptv-proxy] %v | Shutdown: %v, closing the remaining connections\n", time.Now().Format("2006/01/02 - 15:04:05"), e)
+		_ = srv.Close()
+	}
+	if redirect != nil {
+		_ = redirect.Close()
+	}
+
+	// the work sessions are closed with their ffmpeg processes
+	runners.Wait()
+	if n := procgroup.KillAll(); n > 0 {
+		log.Printf("[iptv-proxy] %v | Killed %d ffmpeg processes\n", time.Now().Format("2006/01/02 - 15:04:05"), n)
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// removeTempFiles removes the playlists and guides cached in the
+// temporary directory.
+func (c *Config) removeTempFiles() {
+	_ = os.Remove(c.proxyfiedM3UPath)
+	removeXtreamM3uCache()
+	if c.epg != nil {
+		c.epg.Close()
+	}
 }
 
 func (c *Config) playlistInitialization() error {
@@ -110,42 +336,96 @@ func (c *Config) playlistInitialization() error {
 func (c *Config) marshallInto(into *os.File, xtream bool) error {
 	filteredTrack := make([]m3u.Track, 0, len(c.playlist.Tracks))
 	ret := 0
-	_, _ = into.WriteString("#EXTM3U\n") // nolint: errcheck
-	re := regexp.MustCompile(`FHD|\+|orig| 4K`)
+	if err := c.marshallHeader(into, c.playlist); err != nil {
+		return err
+	}
 
 	for i, track := range c.playlist.Tracks {
-		if re.MatchString(track.Name) {
+		if excludedTrackRegexp.MatchString(track.Name) {
 			ret++
 			continue
 		}
-		var buffer bytes.Buffer
-
-		buffer.WriteString("#EXTINF:")                       // nolint: errcheck
-		buffer.WriteString(fmt.Sprintf("%d ", track.Length)) // nolint: errcheck
 
-		for i := range track.Tags {
-			if i == len(track.Tags)-1 {
-				buffer.WriteString(fmt.Sprintf("%s=%q", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
-				continue
-			}
-			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
-		}
-
-		uri, err := c.replaceURL(track.URI, i-ret, xtream)
-		if err != nil {
+		if err := c.marshallTrack(into, &track, i-ret, xtream); err != nil {
 			ret++
 			log.Printf("ERROR: track: %s: %s", track.Name, err)
 			continue
 		}
-		_, _ = into.WriteString(fmt.Sprintf("%s, %s\n%s\n%s\n", buffer.String(), track.Name, track.Group, uri)) // nolint: errcheck
 
 		filteredTrack = append(filteredTrack, track)
 	}
 	c.playlist.Tracks = filteredTrack
 
+	if err := m3u.WriteTrailer(into, c.playlist); err != nil {
+		return err
+	}
+
 	return into.Sync()
 }
 
+// marshallHeader writes the playlist header, pointing players to our guide.
+func (c *Config) marshallHeader(into io.Writer, p *m3u.Playlist) error {
+	header := *p
+	if epgURL := c.epgURL(c.mainUser()); epgURL != "" {
+		header.Tags = make([]m3u.Tag, 0, len(p.Tags)+2)
+		seen := map[string]bool{}
+		for _, tag := range p.Tags {
+			name := strings.ToLower(tag.Name)
+			if name == "url-tvg" || name == "x-tvg-url" {
+				tag.Value = epgURL
+				seen[name] = true
+			}
+			header.Tags = append(header.Tags, tag)
+		}
+		for _, name := range []string{"url-tvg", "x-tvg-url"} {
+			if !seen[name] {
+				header.Tags = append(header.Tags, m3u.Tag{Name: name, Value: epgURL})
+			}
+		}
+	}
+
+	return m3u.WriteHeader(into, &header)
+}
+
+// trackURL returns the proxified URL of a track of the published
+// playlists, buffered with the timeshift.
+func (c *Config) trackURL(track *m3u.Track, trackIndex int, xtream bool) (string, error) {
+	if uri, ok := c.timeshiftTrackURL(track, trackIndex, xtream); ok {
+		return uri, nil
+	}
+
+	return c.replaceURL(track.URI, trackIndex, xtream)
+}
+
+// marshallTrack writes a track with its proxified URL.
+func (c *Config) marshallTrack(into io.Writer, track *m3u.Track, trackIndex int, xtream bool) error {
+	uri, err := c.trackURL(track, trackIndex, xtream)
+	if err != nil {
+		return err
+	}
+
+	t := *track
+	t.URI = uri
+	t.Tags = c.imageTags(catchupTags(track))
+
+	return m3u.WriteTrack(into, &t)
+}
+
+// advertisedURL returns the public proxy URL of an endpoint path.
+func (c *Config) advertisedURL(endpoint string) string {
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+
+	customEnd := strings.Trim(c.CustomEndpoint, "/")
+	if customEnd != "" {
+		customEnd = fmt.Sprintf("/%s", customEnd)
+	}
+
+	return fmt.Sprintf("%s://%s:%d%s%s", protocol, c.HostConfig.Hostname, c.AdvertisedPort, customEnd, endpoint)
+}
+
 // ReplaceURL replace original playlist url by proxy url
 func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, error) {
 	oriURL, err := url.Parse(uri)
@@ -165,8 +445,17 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 
 	uriPath := oriURL.EscapedPath()
 	if xtream {
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamUser.PathEscape(), c.User.PathEscape())
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamPassword.PathEscape(), c.Password.PathEscape())
+		// only whole segments, credentials may be part of a stream name
+		segments := strings.Split(uriPath, "/")
+		for i, segment := range segments {
+			switch segment {
+			case c.XtreamUser.PathEscape():
+				segments[i] = c.User.PathEscape()
+			case c.XtreamPassword.PathEscape():
+				segments[i] = c.Password.PathEscape()
+			}
+		}
+		uriPath = strings.Join(segments, "/")
 	} else {
 		uriPath = path.Join("/", c.endpointAntiColision, c.User.PathEscape(), c.Password.PathEscape(), fmt.Sprintf("%d", trackIndex), path.Base(uriPath))
 	}
@@ -0,0 +1,286 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/gin-gonic/gin"
+)
+
+// With signed URLs, the playlists don't carry the proxy credentials:
+// the "<user>/<password>" segments of the stream URLs are replaced by
+// "<username>/<token>", the token being signed with the user key for a
+// channel (the next path segment, without extension), an expiry and
+// optionally the client IP. The stream routes are registered twice,
+// Xtream apps still use the credentials: the proxy ones, or the user
+// ones. The HDHomeRun lineup is always signed, media servers can't
+// authenticate, with tokens that don't expire (expiry 0): media servers
+// keep the lineup URLs for days.
+
+var errStreamURLExpired = errors.New("stream URL expired")
+
+// signedContextKey is the gin context key set on the requests
+// authenticated by a signed token.
+const signedContextKey = "iptv-proxy-signed"
+
+// streamRoute registers a stream route, format has the credentials
+// segments as two %s verbs.
+func (c *Config) streamRoute(r *gin.RouterGroup, format string, handlers ...gin.HandlerFunc) {
+	r.GET(fmt.Sprintf(format, c.User, c.Password), append([]gin.HandlerFunc{c.mainStreamUser}, handlers...)...)
+	r.GET(fmt.Sprintf(format, ":username", ":token"), append([]gin.HandlerFunc{c.streamAuthenticate}, handlers...)...)
+}
+
+// mainStreamUser sets the main user of the stream requests carrying the
+// proxy credentials, matched by their route, and applies its access rules.
+func (c *Config) mainStreamUser(ctx *gin.Context) {
+	user := c.mainUser()
+	if user == nil || !c.userAllowed(ctx, user) {
+		return
+	}
+	ctx.Set(userContextKey, user)
+}
+
+// streamToken returns "<expiry>.<signature>", the expiry in base 36.
+func streamToken(user *config.UserAccount, channel string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(user.SigningKey()))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", user.Username, channel, expires, ip)
+
+	return strconv.FormatInt(expires, 36) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// signedChannel returns the channel of a stream path, the segment
+// following the credentials ones.
+func signedChannel(p, first, second string) (string, bool) {
+	segments := strings.Split(p, "/")
+	for i := 0; i+2 < len(segments); i++ {
+		if segments[i] == first && segments[i+1] == second {
+			channel := segments[i+2]
+			return strings.TrimSuffix(channel, path.Ext(channel)), true
+		}
+	}
+
+	return "", false
+}
+
+// urlSigner returns the function signing the proxy URLs for the request
+// user, nil when the URLs are not signed.
+func (c *Config) urlSigner(ctx *gin.Context) func(string) string {
+	user := requestUser(ctx)
+	if !c.SignedURLs || user == nil {
+		return nil
+	}
+
+	return c.signer(ctx, user)
+}
+
+// signer returns the function signing the proxy URLs for a user.
+func (c *Config) signer(ctx *gin.Context, user *config.UserAccount) func(string) string {
+	return c.signerUntil(ctx, user, time.Now().Add(time.Duration(c.SignedURLsTTL)*time.Hour).Unix())
+}
+
+// signerUntil returns the function signing the proxy URLs for a user
+// until expires, a Unix time, 0 for tokens that don't expire.
+func (c *Config) signerUntil(ctx *gin.Context, user *config.UserAccount, expires int64) func(string) string {
+	ip := ""
+	if c.SignedURLsIP {
+		ip = ctx.ClientIP()
+	}
+
+	return func(uri string) string {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return uri
+		}
+		channel, ok := signedChannel(u.Path, c.User.String(), c.Password.String())
+		if !ok {
+			return uri
+		}
+
+		credentials := "/" + c.User.String() + "/" + c.Password.String() + "/"
+		signed := "/" + user.Username.String() + "/" + streamToken(user, channel, expires, ip) + "/"
+		u.Path = strings.Replace(u.Path, credentials, signed, 1)
+		u.RawPath = ""
+
+		return u.String()
+	}
+}
+
+// userURLs returns the function rewriting the proxy URLs, made with the
+// main user credentials, for the request user: signed, or with the user
+// credentials. It is nil when they are kept as is.
+func (c *Config) userURLs(ctx *gin.Context) func(string) string {
+	if sign := c.urlSigner(ctx); sign != nil {
+		return sign
+	}
+
+	return c.credentialsURLs(requestUser(ctx))
+}
+
+// credentialsURLs returns the function rewriting the proxy URLs with the
+// user credentials, nil for the main user.
+func (c *Config) credentialsURLs(user *config.UserAccount) func(string) string {
+	if user == nil || user.Username == c.User {
+		return nil
+	}
+
+	credentials := "/" + c.User.PathEscape() + "/" + c.Password.PathEscape() + "/"
+	own := "/" + user.Username.PathEscape() + "/" + url.PathEscape(user.URLPassword()) + "/"
+	return func(uri string) string {
+		return strings.Replace(uri, credentials, own, 1)
+	}
+}
+
+// rewritePlaylist copies an m3u playlist, rewriting its URLs and the
+// guide URL of its header. The line endings are kept.
+func rewritePlaylist(w io.Writer, r io.Reader, rewrite func(string) string, guide, userGuide string) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			text := strings.TrimRight(line, "\r\n")
+			eol := line[len(text):]
+			switch {
+			case strings.HasPrefix(strings.TrimPrefix(text, "\ufeff"), "#EXTM3U"):
+				if guide != "" {
+					text = strings.ReplaceAll(text, guide, userGuide)
+				}
+			case text != "" && !strings.HasPrefix(text, "#"):
+				text = rewrite(text)
+			}
+			if _, err := io.WriteString(w, text+eol); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// streamAuthenticate authenticates the stream requests carrying a
+// signed token or the user credentials.
+func (c *Config) streamAuthenticate(ctx *gin.Context) {
+	username, token := ctx.Param("username"), ctx.Param("token")
+	if c.lockedOut(ctx, username) {
+		return
+	}
+	user, err := c.verifyStreamToken(ctx, username, token)
+	if err == nil {
+		c.authSucceeded(ctx, username)
+		if c.userAllowed(ctx, user) {
+			ctx.Set(userContextKey, user)
+			ctx.Set(signedContextKey, true)
+		}
+		return
+	}
+	if errors.Is(err, errStreamURLExpired) {
+		_ = ctx.AbortWithError(http.StatusGone, err) // nolint: errcheck
+		return
+	}
+
+	user, ok := c.streamCredentials(username, token)
+	if !ok {
+		c.authFailed(ctx, username)
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.authSucceeded(ctx, username)
+	if !c.userAllowed(ctx, user) {
+		return
+	}
+	ctx.Set(userContextKey, user)
+}
+
+// streamCredentials returns the user matching the credentials of a
+// stream URL, the password of the hashed ones being the secret standing
+// for it.
+func (c *Config) streamCredentials(username, password string) (*config.UserAccount, bool) {
+	if user, ok := c.credentials(username, password); ok {
+		return user, true
+	}
+	user, ok := c.Users.User(username)
+	if !ok || !config.IsPasswordHash(user.Password.String()) {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(user.URLPassword())) != 1 {
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (c *Config) verifyStreamToken(ctx *gin.Context, username, token string) (*config.UserAccount, error) {
+	user, ok := c.Users.User(username)
+	if !ok {
+		return nil, errors.New("unknown user")
+	}
+
+	expiry, _, _ := strings.Cut(token, ".")
+	expires, err := strconv.ParseInt(expiry, 36, 64)
+	if err != nil {
+		return nil, err
+	}
+	channel, _ := signedChannel(ctx.Request.URL.Path, username, token)
+	ip := ""
+	if c.SignedURLsIP {
+		ip = ctx.ClientIP()
+	}
+	if !hmac.Equal([]byte(token), []byte(streamToken(user, channel, expires, ip))) {
+		return nil, errors.New("invalid stream token")
+	}
+	if expires != 0 && time.Now().Unix() > expires {
+		return nil, errStreamURLExpired
+	}
+
+	return user, nil
+}
+
+// publicURL rewrites a proxy URL given to the client of a stream request:
+// signed for a signed request, the credentials stay hidden, with the
+// request user credentials otherwise.
+func (c *Config) publicURL(ctx *gin.Context, uri string) string {
+	if ctx.GetBool(signedContextKey) {
+		if sign := c.urlSigner(ctx); sign != nil {
+			return sign(uri)
+		}
+	}
+	if rewrite := c.credentialsURLs(requestUser(ctx)); rewrite != nil {
+		return rewrite(uri)
+	}
+
+	return uri
+}
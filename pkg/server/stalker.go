@@ -0,0 +1,359 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/gin-gonic/gin"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// Stalker middleware portal emulation, for MAG set-top boxes.
+// Boxes are authenticated by MAC address, then by the token given at handshake.
+
+const (
+	stalkerPageSize      = 14
+	stalkerSessionExpiry = 24 * time.Hour
+)
+
+type stalkerSession struct {
+	user    *config.UserAccount
+	mac     string
+	expires time.Time
+}
+
+var stalkerSessions = map[string]stalkerSession{}
+var stalkerSessionsLock = sync.RWMutex{}
+
+type stalkerGenre struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Alias  string `json:"alias"`
+	Number int    `json:"number"`
+}
+
+type stalkerChannel struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Number        string `json:"number"`
+	Cmd           string `json:"cmd"`
+	Logo          string `json:"logo"`
+	GenreID       string `json:"tv_genre_id"`
+	XMLTVID       string `json:"xmltv_id"`
+	UseTmpLink    string `json:"use_http_tmp_link"`
+	Status        int    `json:"status"`
+	Censored      int    `json:"censored"`
+	Archive       int    `json:"archive"`
+	Fav           int    `json:"fav"`
+	EnableArchive int    `json:"enable_tv_archive"`
+}
+
+type stalkerPage struct {
+	TotalItems   int              `json:"total_items"`
+	MaxPageItems int              `json:"max_page_items"`
+	SelectedItem int              `json:"selected_item"`
+	CurPage      int              `json:"cur_page"`
+	Data         []stalkerChannel `json:"data"`
+}
+
+func (c *Config) stalkerRoutes(r *gin.RouterGroup) {
+	if !c.Stalker {
+		return
+	}
+
+	r.GET("/stalker_portal/server/load.php", c.stalkerLoad)
+	r.GET("/portal.php", c.stalkerLoad)
+}
+
+func stalkerJS(ctx *gin.Context, js interface{}) {
+	ctx.JSON(http.StatusOK, gin.H{"js": js})
+}
+
+// stalkerMAC returns the box MAC address, from the "mac" cookie or query parameter.
+func stalkerMAC(ctx *gin.Context) string {
+	mac, err := ctx.Cookie("mac")
+	if err != nil || mac == "" {
+		mac = ctx.Query("mac")
+	}
+
+	return config.NormalizeMAC(mac)
+}
+
+func newStalkerToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// stalkerSessionFromRequest returns the session of the "Authorization: Bearer" token.
+func stalkerSessionFromRequest(ctx *gin.Context) (stalkerSession, bool) {
+	token := strings.TrimSpace(strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer"))
+	if token == "" {
+		return stalkerSession{}, false
+	}
+
+	stalkerSessionsLock.RLock()
+	session, ok := stalkerSessions[token]
+	stalkerSessionsLock.RUnlock()
+	if !ok || time.Now().After(session.expires) {
+		return stalkerSession{}, false
+	}
+
+	return session, true
+}
+
+func (c *Config) stalkerLoad(ctx *gin.Context) {
+	t := ctx.Query("type")
+	action := ctx.Query("action")
+
+	log.Printf("[iptv-proxy] %v | %s |Stalker\t%s %s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), t, action)
+
+	if t == "stb" && action == "handshake" {
+		c.stalkerHandshake(ctx)
+		return
+	}
+
+	session, ok := stalkerSessionFromRequest(ctx)
+	if !ok {
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	ctx.Set(userContextKey, session.user)
+
+	switch t + "/" + action {
+	case "stb/get_profile":
+		stalkerJS(ctx, gin.H{
+			"id":               session.mac,
+			"name":             session.user.Username.String(),
+			"mac":              session.mac,
+			"status":           0,
+			"blocked":          "0",
+			"locale":           "en_GB.utf8",
+			"timezone":         time.Now().Location().String(),
+			"watchdog_timeout": 120,
+		})
+	case "stb/get_localization":
+		stalkerJS(ctx, gin.H{})
+	case "watchdog/get_events":
+		stalkerJS(ctx, gin.H{"data": gin.H{"msgs": 0, "additional_services_on": 1}})
+	case "account_info/get_main_info":
+		stalkerJS(ctx, gin.H{"mac": session.mac, "fname": session.user.Username.String(), "phone": "", "end_date": ""})
+	case "itv/get_genres":
+		genres, _, err := c.stalkerLineup(ctx)
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		stalkerJS(ctx, append([]stalkerGenre{{ID: "*", Title: "All", Alias: "all"}}, genres...))
+	case "itv/get_all_channels", "itv/get_ordered_list":
+		_, channels, err := c.stalkerLineup(ctx)
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		stalkerJS(ctx, stalkerChannelsPage(ctx, action, channels))
+	case "itv/create_link":
+		// The channel cmd already is the proxified stream URL.
+		cmd := ctx.Query("cmd")
+		stalkerJS(ctx, gin.H{"id": ctx.Query("id"), "cmd": cmd})
+	case "itv/get_epg_info", "itv/get_short_epg":
+		stalkerJS(ctx, []struct{}{})
+	default:
+		stalkerJS(ctx, gin.H{})
+	}
+}
+
+func (c *Config) stalkerHandshake(ctx *gin.Context) {
+	mac := stalkerMAC(ctx)
+	if !c.admit(ctx, "") {
+		return
+	}
+	user, ok := c.Users.ByMAC(mac)
+	if !ok {
+		c.authFailed(ctx, "")
+		log.Printf("[iptv-proxy] %v | %s |Stalker unknown MAC %q\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), mac)
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	if !c.userAllowed(ctx, user) {
+		return
+	}
+
+	token, err := newStalkerToken()
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	now := time.Now()
+	stalkerSessionsLock.Lock()
+	for k, s := range stalkerSessions {
+		if now.After(s.expires) {
+			delete(stalkerSessions, k)
+		}
+	}
+	stalkerSessions[token] = stalkerSession{user: user, mac: mac, expires: now.Add(stalkerSessionExpiry)}
+	stalkerSessionsLock.Unlock()
+
+	stalkerJS(ctx, gin.H{"token": token})
+}
+
+// stalkerChannelsPage returns all the channels, or a page of a genre for get_ordered_list.
+func stalkerChannelsPage(ctx *gin.Context, action string, channels []stalkerChannel) stalkerPage {
+	if action == "get_all_channels" {
+		return stalkerPage{TotalItems: len(channels), MaxPageItems: len(channels), Data: channels}
+	}
+
+	genre := ctx.Query("genre")
+	filtered := channels
+	if genre != "" && genre != "*" {
+		filtered = make([]stalkerChannel, 0)
+		for _, ch := range channels {
+			if ch.GenreID == genre {
+				filtered = append(filtered, ch)
+			}
+		}
+	}
+
+	page, err := strconv.Atoi(ctx.Query("p"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	start := (page - 1) * stalkerPageSize
+	if start > len(filtered) {
+		start = len(filtered)
+	}
+	end := start + stalkerPageSize
+	if end > len(filtered) {
+		end = len(filtered)
+	}
+
+	return stalkerPage{
+		TotalItems:   len(filtered),
+		MaxPageItems: stalkerPageSize,
+		CurPage:      page,
+		SelectedItem: 0,
+		Data:         filtered[start:end],
+	}
+}
+
+// stalkerLineup returns the genres and channels, from the Xtream backend
+// live streams if there is one, from the proxified playlist otherwise.
+func (c *Config) stalkerLineup(ctx *gin.Context) ([]stalkerGenre, []stalkerChannel, error) {
+	if c.XtreamBaseURL != "" {
+		return c.stalkerXtreamLineup(ctx)
+	}
+
+	ids, groups := c.localCategoryIDs()
+	genres := make([]stalkerGenre, 0, len(groups))
+	for i, group := range groups {
+		genres = append(genres, stalkerGenre{ID: ids[group], Title: group, Alias: strings.ToLower(group), Number: i + 1})
+	}
+
+	rewrite := c.userURLs(ctx)
+	channels := make([]stalkerChannel, 0, len(c.playlist.Tracks))
+	for i := range c.playlist.Tracks {
+		track := &c.playlist.Tracks[i]
+		uri, err := c.replaceURL(track.URI, i, false)
+		if err != nil {
+			log.Printf("ERROR: track: %s: %s", track.Name, err)
+			continue
+		}
+		if rewrite != nil {
+			uri = rewrite(uri)
+		}
+
+		number := track.Tag("tvg-chno")
+		if number == "" {
+			number = strconv.Itoa(i + 1)
+		}
+
+		channels = append(channels, stalkerChannel{
+			ID:         strconv.Itoa(i + 1),
+			Name:       track.Name,
+			Number:     number,
+			Cmd:        "ffrt " + uri,
+			Logo:       c.imageURL(track.Tag("tvg-logo")),
+			GenreID:    ids[trackGroup(track)],
+			XMLTVID:    track.Tag("tvg-id"),
+			UseTmpLink: "0",
+			Status:     1,
+		})
+	}
+
+	return genres, channels, nil
+}
+
+func (c *Config) stalkerXtreamLineup(ctx *gin.Context) ([]stalkerGenre, []stalkerChannel, error) {
+	resp, _, err := c.xtreamAPI.Action(ctx.Request.Context(), ctx.Request.UserAgent(), "get_live_categories", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	categories, _ := c.filterXtreamResponse(ctx, "get_live_categories", resp).([]xtream.Category)
+
+	genres := make([]stalkerGenre, 0, len(categories))
+	for i, cat := range categories {
+		genres = append(genres, stalkerGenre{ID: fmt.Sprint(cat.ID), Title: cat.Name, Alias: strings.ToLower(cat.Name), Number: i + 1})
+	}
+
+	resp, _, err = c.xtreamAPI.Action(ctx.Request.Context(), ctx.Request.UserAgent(), "get_live_streams", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	streams, _ := c.filterXtreamResponse(ctx, "get_live_streams", resp).([]xtream.Stream)
+
+	rewrite := c.userURLs(ctx)
+	channels := make([]stalkerChannel, 0, len(streams))
+	for _, stream := range streams {
+		if excludedTrackRegexp.MatchString(stream.Name) {
+			continue
+		}
+		uri := c.advertisedURL(fmt.Sprintf("/live/%s/%s/%d.ts", c.User.PathEscape(), c.Password.PathEscape(), stream.ID))
+		if rewrite != nil {
+			uri = rewrite(uri)
+		}
+		channels = append(channels, stalkerChannel{
+			ID:         fmt.Sprint(stream.ID),
+			Name:       stream.Name,
+			Number:     fmt.Sprint(stream.Number),
+			Cmd:        "ffrt " + uri,
+			Logo:       stream.Icon,
+			GenreID:    fmt.Sprint(stream.CategoryID),
+			XMLTVID:    stream.EPGChannelID,
+			UseTmpLink: "0",
+			Status:     1,
+			Archive:    int(stream.TVArchive),
+		})
+	}
+
+	return genres, channels, nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/buga1234/iptv-proxy/pkg/timeshift"
+	"github.com/gin-gonic/gin"
+)
+
+// Buffered channels are identified by their Xtream stream id: the
+// provider one with an Xtream backend, the emulated one (track index + 1)
+// otherwise. Their buffers are work directory sessions.
+const timeshiftPlaylist = "index.m3u8"
+
+func (c *Config) timeshiftRoutes(r *gin.RouterGroup) {
+	if c.timeshift == nil {
+		return
+	}
+
+	c.streamRoute(r, "/buffer/%s/%s/:id/:file", c.timeshiftHandler)
+}
+
+// timeshiftURL returns the buffered playlist URL of a channel.
+func (c *Config) timeshiftURL(id string) string {
+	return c.advertisedURL(fmt.Sprintf("/buffer/%s/%s/%s/%s", c.User.PathEscape(), c.Password.PathEscape(), id, timeshiftPlaylist))
+}
+
+// timeshiftTrackURL returns the buffered URL of a live track of the
+// published playlists, ok is false for the other tracks.
+func (c *Config) timeshiftTrackURL(track *m3u.Track, trackIndex int, xtream bool) (string, bool) {
+	if c.timeshift == nil {
+		return "", false
+	}
+	u, err := url.Parse(track.URI)
+	if err != nil {
+		return "", false
+	}
+
+	ext := path.Ext(u.Path)
+	if ext != "" && ext != ".ts" && ext != ".m3u8" {
+		return "", false
+	}
+	if xtream {
+		// "/live/user/password/id.ts"
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) < 4 || parts[len(parts)-4] != "live" {
+			return "", false
+		}
+		return c.timeshiftURL(strings.TrimSuffix(parts[len(parts)-1], ext)), true
+	}
+	if strings.Contains(u.Path, "/movie/") || strings.Contains(u.Path, "/series/") {
+		return "", false
+	}
+
+	return c.timeshiftURL(strconv.Itoa(trackIndex + 1)), true
+}
+
+// timeshiftChannel returns the upstream URL of a buffered channel,
+// and its m3u track without Xtream backend.
+func (c *Config) timeshiftChannel(id string) (*url.URL, *m3u.Track, error) {
+	streamID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.XtreamBaseURL != "" {
+		u, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%d.ts", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, streamID))
+		return u, nil, err
+	}
+
+	track, err := c.localTrack(streamID)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := url.Parse(track.URI)
+
+	return u, track, err
+}
+
+func (c *Config) timeshiftOpen(ctx context.Context, channel string) (io.ReadCloser, error) {
+	u, _, err := c.timeshiftChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.openLive(ctx, u)
+}
+
+func (c *Config) timeshiftHandler(ctx *gin.Context) {
+	id, file := ctx.Param("id"), ctx.Param("file")
+	_, track, err := c.timeshiftChannel(id)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+
+	if file != timeshiftPlaylist {
+		p, err := c.timeshift.Segment(id, file)
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+			return
+		}
+		ctx.Header("Content-Type", "video/mp2t")
+		ctx.File(p)
+		return
+	}
+
+	// the archive is older than the buffer
+	if track != nil && c.serveTrackCatchup(ctx, track) {
+		return
+	}
+	if track == nil && c.serveXtreamCatchup(ctx) {
+		return
+	}
+
+	playlist, err := c.timeshift.Playlist(ctx.Request.Context(), id)
+	switch {
+	case errors.Is(err, errStreamLimit), errors.Is(err, timeshift.ErrNotReady):
+		_ = ctx.AbortWithError(http.StatusServiceUnavailable, err) // nolint: errcheck
+		return
+	case err != nil:
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Data(http.StatusOK, "application/vnd.apple.mpegurl", playlist)
+}
+
+// serveTimeshift redirects the HLS requests of a live stream to its
+// buffer, it returns false when the stream is not buffered.
+func (c *Config) serveTimeshift(ctx *gin.Context, id string) bool {
+	if c.timeshift == nil || path.Ext(id) != ".m3u8" {
+		return false
+	}
+
+	ctx.Redirect(http.StatusFound, c.publicURL(ctx, c.timeshiftURL(strings.TrimSuffix(id, ".m3u8"))))
+
+	return true
+}
@@ -0,0 +1,70 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With client certificates, the devices presenting one signed by the
+// client CAs are trusted: the access rules, rate limits and lockouts
+// don't apply to them, they still authenticate.
+
+// trustedDevice returns true if the client presented a verified certificate.
+func trustedDevice(ctx *gin.Context) bool {
+	return ctx.Request.TLS != nil && len(ctx.Request.TLS.VerifiedChains) > 0
+}
+
+// redirectHTTPS serves the redirect port in the background, the plain
+// HTTP requests are redirected to the advertised HTTPS URL.
+func (c *Config) redirectHTTPS() *http.Server {
+	addr := ":" + strconv.Itoa(c.HTTPRedirectPort)
+	log.Printf("[iptv-proxy] %v | Redirecting HTTP on %s to HTTPS\n", time.Now().Format("2006/01/02 - 15:04:05"), addr)
+
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := c.HostConfig.Hostname
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		} else if r.Host != "" {
+			host = r.Host
+		}
+		if c.AdvertisedPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(c.AdvertisedPort))
+		}
+
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("[iptv-proxy] %v | HTTP redirect: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+		}
+	}()
+
+	return srv
+}
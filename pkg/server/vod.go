@@ -0,0 +1,58 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/buga1234/iptv-proxy/pkg/vodcache"
+	"github.com/gin-gonic/gin"
+)
+
+// serveVOD serves a movie or an episode from the VOD cache,
+// kind is "movie" or "series". The stream is proxied as is when the
+// cache is off or the provider doesn't support range requests.
+func (c *Config) serveVOD(ctx *gin.Context, kind string, oriURL *url.URL) {
+	id := ctx.Param("id")
+	if c.vod == nil || strings.HasSuffix(id, ".m3u8") {
+		c.xtreamStream(ctx, oriURL)
+		return
+	}
+
+	r, err := c.vod.Open(ctx.Request.Context(), kind+"/"+id, oriURL.String(), ctx.Request.UserAgent())
+	if errors.Is(err, vodcache.ErrNoRange) {
+		c.stream(ctx, oriURL)
+		return
+	}
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+	defer r.Close()
+
+	meta := r.Meta()
+	if meta.ContentType != "" {
+		ctx.Header("Content-Type", meta.ContentType)
+	}
+	// Range, If-Range and conditional requests
+	http.ServeContent(ctx.Writer, ctx.Request, id, meta.ModTime, r)
+}
@@ -0,0 +1,243 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	xtreamapi "github.com/buga1234/iptv-proxy/pkg/xtream-proxy"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// player_api.php responses cache.
+// Fresh responses are served from memory, stale ones are served while
+// they are refreshed in background, so players never wait for the provider
+// but on the first request of an action.
+
+// how long a response is fresh, by action ("" is the login)
+var xtreamAPITTL = map[string]time.Duration{
+	"":                      time.Minute,
+	"get_live_categories":   6 * time.Hour,
+	"get_vod_categories":    6 * time.Hour,
+	"get_series_categories": 6 * time.Hour,
+	"get_live_streams":      time.Hour,
+	"get_vod_streams":       time.Hour,
+	"get_series":            time.Hour,
+	"get_vod_info":          12 * time.Hour,
+	"get_series_info":       12 * time.Hour,
+	"get_short_epg":         10 * time.Minute,
+	"get_simple_data_table": 10 * time.Minute,
+}
+
+const (
+	defaultXtreamAPITTL = 10 * time.Minute
+	// how long a stale response may still be served
+	xtreamAPIMaxStale = 24 * time.Hour
+	// the provider session is renewed at this interval
+	xtreamClientMaxAge = time.Hour
+)
+
+type xtreamAPIEntry struct {
+	resp    interface{}
+	fetched time.Time
+	// closed once the running fetch is done, nil when there is none
+	loading  chan struct{}
+	err      error
+	httpcode int
+}
+
+// xtreamAPICache caches the player_api.php actions, with a single
+// long-lived provider client.
+type xtreamAPICache struct {
+	config *config.ProxyConfig
+
+	lock      sync.Mutex
+	client    *xtreamapi.Client
+	clientAge time.Time
+	entries   map[string]*xtreamAPIEntry
+	pruned    time.Time
+	// category names by id of the categories actions, the last fetched
+	// ones are kept: streams of unknown categories are filtered out
+	categories map[string]map[string]string
+}
+
+func newXtreamAPICache(config *config.ProxyConfig) *xtreamAPICache {
+	return &xtreamAPICache{
+		config:     config,
+		entries:    map[string]*xtreamAPIEntry{},
+		pruned:     time.Now(),
+		categories: map[string]map[string]string{},
+	}
+}
+
+// Client returns the shared provider client, logging in when needed.
+func (a *xtreamAPICache) Client(userAgent string) (*xtreamapi.Client, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.clientLocked(userAgent, false)
+}
+
+func (a *xtreamAPICache) clientLocked(userAgent string, renew bool) (*xtreamapi.Client, error) {
+	if a.client != nil && !renew && time.Since(a.clientAge) < xtreamClientMaxAge {
+		return a.client, nil
+	}
+
+	client, err := xtreamapi.New(a.config.XtreamUser.String(), a.config.XtreamPassword.String(), a.config.XtreamBaseURL, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	a.client, a.clientAge = client, time.Now()
+
+	return client, nil
+}
+
+// xtreamAPIKey is the action and its parameters, without credentials.
+func xtreamAPIKey(action string, q url.Values) string {
+	params := url.Values{}
+	for k, v := range q {
+		if k == "username" || k == "password" || k == "action" {
+			continue
+		}
+		params[k] = v
+	}
+
+	return action + "?" + params.Encode()
+}
+
+// Action returns the action response, from the cache when possible.
+func (a *xtreamAPICache) Action(ctx context.Context, userAgent, action string, q url.Values) (interface{}, int, error) {
+	ttl, ok := xtreamAPITTL[action]
+	if !ok {
+		ttl = defaultXtreamAPITTL
+	}
+	key := xtreamAPIKey(action, q)
+
+	a.lock.Lock()
+	a.pruneLocked()
+	e := a.entries[key]
+	if e == nil {
+		e = &xtreamAPIEntry{}
+		a.entries[key] = e
+	}
+
+	age := time.Since(e.fetched)
+	if e.resp != nil && age < ttl {
+		resp := e.resp
+		a.lock.Unlock()
+		return resp, http.StatusOK, nil
+	}
+	if e.loading == nil {
+		e.loading = make(chan struct{})
+		go a.fetch(e, userAgent, action, q)
+	}
+	if e.resp != nil && age < ttl+xtreamAPIMaxStale {
+		resp := e.resp
+		a.lock.Unlock()
+		return resp, http.StatusOK, nil
+	}
+	loading := e.loading
+	a.lock.Unlock()
+
+	select {
+	case <-loading:
+	case <-ctx.Done():
+		return nil, http.StatusGatewayTimeout, ctx.Err()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if e.resp == nil || time.Since(e.fetched) >= ttl+xtreamAPIMaxStale {
+		return nil, e.httpcode, e.err
+	}
+
+	return e.resp, http.StatusOK, nil
+}
+
+// CategoryNames returns the category names by id of a categories action,
+// the last fetched ones if the provider fails.
+func (a *xtreamAPICache) CategoryNames(ctx context.Context, userAgent, action string) map[string]string {
+	resp, _, err := a.Action(ctx, userAgent, action, nil)
+	categories, ok := resp.([]xtream.Category)
+	if err != nil || !ok {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.categories[action]
+	}
+
+	names := make(map[string]string, len(categories))
+	for _, cat := range categories {
+		names[fmt.Sprint(cat.ID)] = cat.Name
+	}
+	a.lock.Lock()
+	a.categories[action] = names
+	a.lock.Unlock()
+
+	return names
+}
+
+// fetch requests the provider, the login action renews the provider session.
+func (a *xtreamAPICache) fetch(e *xtreamAPIEntry, userAgent, action string, q url.Values) {
+	a.lock.Lock()
+	client, err := a.clientLocked(userAgent, action == "")
+	a.lock.Unlock()
+
+	var resp interface{}
+	httpcode := http.StatusBadGateway
+	if err == nil {
+		resp, httpcode, err = client.Action(a.config, action, q)
+	}
+	if err != nil && httpcode == 0 {
+		httpcode = http.StatusBadGateway
+	}
+	if err != nil {
+		log.Printf("[iptv-proxy] %v | xtream action %q: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), action, err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err == nil {
+		e.resp, e.fetched = resp, time.Now()
+	}
+	e.err, e.httpcode = err, httpcode
+	close(e.loading)
+	e.loading = nil
+}
+
+// pruneLocked drops the entries too old to be served, every hour.
+func (a *xtreamAPICache) pruneLocked() {
+	if time.Since(a.pruned) < time.Hour {
+		return
+	}
+	a.pruned = time.Now()
+
+	for key, e := range a.entries {
+		if e.loading == nil && time.Since(e.fetched) > xtreamAPIMaxStale+12*time.Hour {
+			delete(a.entries, key)
+		}
+	}
+}
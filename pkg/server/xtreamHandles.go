@@ -19,6 +19,9 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -27,6 +30,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +40,7 @@ import (
 	xtreamapi "github.com/buga1234/iptv-proxy/pkg/xtream-proxy"
 	"github.com/gin-gonic/gin"
 	uuid "github.com/satori/go.uuid"
+	xtream "github.com/tellytv/go.xtream-codes"
 )
 
 type cacheMeta struct {
@@ -51,36 +57,166 @@ var xtreamM3uCache = map[string]cacheMeta{}
 var xtreamM3uCacheLock = sync.RWMutex{}
 
 func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error {
-	xtreamM3uCacheLock.Lock()
-	defer xtreamM3uCacheLock.Unlock()
-
 	tmp := *c
 	tmp.playlist = playlist
 
+	return writeXtreamM3uCache(cacheName, func(f *os.File) error {
+		return tmp.marshallInto(f, true)
+	})
+}
+
+// cacheXtreamM3uURL proxifies the provider playlist track by track,
+// it is never entirely loaded in memory.
+func (c *Config) cacheXtreamM3uURL(ctx context.Context, m3uURL, cacheName string) error {
+	return writeXtreamM3uCache(cacheName, func(f *os.File) error {
+		w := bufio.NewWriter(f)
+
+		d := &m3u.Decoder{
+			OnHeader: func(p m3u.Playlist) error {
+				return c.marshallHeader(w, &p)
+			},
+			OnTrack: func(track m3u.Track) error {
+				if !c.filterTrack(&track) {
+					return nil
+				}
+				if err := c.marshallTrack(w, &track, 0, true); err != nil {
+					log.Printf("ERROR: track: %s: %s", track.Name, err)
+				}
+				return nil
+			},
+		}
+		p, err := d.DecodeFile(ctx, m3uURL)
+		if err != nil {
+			return err
+		}
+		if err := m3u.WriteTrailer(w, &p); err != nil {
+			return err
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return f.Sync()
+	})
+}
+
+// writeXtreamM3uCache writes the cacheName m3u file with write. It is
+// written to a new file, renamed over the cached one: the cache is only
+// locked for the rename and the file being served is left untouched.
+func writeXtreamM3uCache(cacheName string, write func(f *os.File) error) error {
 	path := filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	defer func(f *os.File) {
-		_ = f.Close()
-	}(f)
 
-	if err := tmp.marshallInto(f, true); err != nil {
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
 		return err
 	}
+
+	xtreamM3uCacheLock.Lock()
+	defer xtreamM3uCacheLock.Unlock()
+
+	if meta, ok := xtreamM3uCache[cacheName]; ok {
+		if err := os.Rename(path, meta.string); err != nil {
+			_ = os.Remove(path)
+			return err
+		}
+		path = meta.string
+	}
 	xtreamM3uCache[cacheName] = cacheMeta{path, time.Now()}
 
 	return nil
 }
 
+// removeXtreamM3uCache removes the cached m3u files.
+func removeXtreamM3uCache() {
+	xtreamM3uCacheLock.Lock()
+	defer xtreamM3uCacheLock.Unlock()
+
+	for name, meta := range xtreamM3uCache {
+		_ = os.Remove(meta.string)
+		delete(xtreamM3uCache, name)
+	}
+}
+
+// concurrent get_series_info requests when generating the m3u
+const xtreamSeriesInfoWorkers = 4
+
+// xtreamGenerateM3u builds the playlist of the provider streams from the
+// cached player_api.php actions. It is shared by the users, only the
+// global filter rules apply.
 func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
-	if err != nil {
-		return nil, err
+	api := xtreamActions{ctx: ctx.Request.Context(), userAgent: ctx.Request.UserAgent(), cache: c.xtreamAPI}
+
+	var playlist = new(m3u.Playlist)
+	playlist.Tracks = make([]m3u.Track, 0)
+
+	var err error
+	if c.XtreamM3uLive.Enabled {
+		if playlist.Tracks, err = c.xtreamLiveTracks(api, playlist.Tracks, extension); err != nil {
+			return nil, err
+		}
+	}
+	if c.XtreamM3uVOD.Enabled {
+		if playlist.Tracks, err = c.xtreamVODTracks(api, playlist.Tracks); err != nil {
+			return nil, err
+		}
+	}
+	if c.XtreamM3uSeries.Enabled {
+		if playlist.Tracks, err = c.xtreamSeriesTracks(api, playlist.Tracks); err != nil {
+			return nil, err
+		}
 	}
 
-	cat, err := client.GetLiveCategories()
+	return playlist, nil
+}
+
+// xtreamActions requests the provider through the player_api.php cache.
+type xtreamActions struct {
+	ctx       context.Context
+	userAgent string
+	cache     *xtreamAPICache
+}
+
+func (a xtreamActions) categories(action string) ([]xtream.Category, error) {
+	resp, _, err := a.cache.Action(a.ctx, a.userAgent, action, nil)
+	categories, _ := resp.([]xtream.Category)
+
+	return categories, err
+}
+
+func (a xtreamActions) streams(action, categoryID string) ([]xtream.Stream, error) {
+	resp, _, err := a.cache.Action(a.ctx, a.userAgent, action, url.Values{"category_id": {categoryID}})
+	streams, _ := resp.([]xtream.Stream)
+
+	return streams, err
+}
+
+func (a xtreamActions) series(categoryID string) ([]xtream.SeriesInfo, error) {
+	resp, _, err := a.cache.Action(a.ctx, a.userAgent, "get_series", url.Values{"category_id": {categoryID}})
+	series, _ := resp.([]xtream.SeriesInfo)
+
+	return series, err
+}
+
+func (a xtreamActions) seriesInfo(seriesID string) (*xtream.Series, error) {
+	resp, _, err := a.cache.Action(a.ctx, a.userAgent, "get_series_info", url.Values{"series_id": {seriesID}})
+	info, _ := resp.(*xtream.Series)
+	if err == nil && info == nil {
+		err = fmt.Errorf("no series %s", seriesID)
+	}
+
+	return info, err
+}
+
+func (c *Config) xtreamLiveTracks(api xtreamActions, tracks []m3u.Track, extension string) ([]m3u.Track, error) {
+	cat, err := api.categories("get_live_categories")
 	if err != nil {
 		return nil, err
 	}
@@ -93,11 +229,12 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 		prefix = "live/"
 	}
 
-	var playlist = new(m3u.Playlist)
-	playlist.Tracks = make([]m3u.Track, 0)
-
 	for _, category := range cat {
-		live, err := client.GetLiveStreams(fmt.Sprint(category.ID))
+		if _, ok := c.Filter.Group(category.Name); !ok || !c.XtreamM3uLive.Include(category.Name) {
+			continue
+		}
+
+		live, err := api.streams("get_live_streams", fmt.Sprint(category.ID))
 		if err != nil {
 			return nil, err
 		}
@@ -109,22 +246,168 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 			if stream.EPGChannelID != "" {
 				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: stream.EPGChannelID})
 			}
-			if stream.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: stream.Name})
+			track.Tags = xtreamTrackTags(track.Tags, stream.Name, stream.Icon, category.Name)
+			if stream.TVArchive != 0 {
+				days := 1
+				if stream.TVArchiveDuration != nil && *stream.TVArchiveDuration > 0 {
+					days = int(*stream.TVArchiveDuration)
+				}
+				track.Tags = append(track.Tags, m3u.Tag{Name: "catchup", Value: "xc"}, m3u.Tag{Name: "catchup-days", Value: strconv.Itoa(days)})
 			}
-			if stream.Icon != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: stream.Icon})
+
+			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, prefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.ID), extension)
+			if c.filterTrack(&track) {
+				tracks = append(tracks, track)
 			}
-			if category.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.Name})
+		}
+	}
+
+	return tracks, nil
+}
+
+func (c *Config) xtreamVODTracks(api xtreamActions, tracks []m3u.Track) ([]m3u.Track, error) {
+	cat, err := api.categories("get_vod_categories")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, category := range cat {
+		if _, ok := c.Filter.Group(category.Name); !ok || !c.XtreamM3uVOD.Include(category.Name) {
+			continue
+		}
+
+		movies, err := api.streams("get_vod_streams", fmt.Sprint(category.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, movie := range movies {
+			track := m3u.Track{Name: movie.Name, Length: -1}
+			track.Tags = xtreamTrackTags(nil, movie.Name, movie.Icon, category.Name)
+			track.URI = fmt.Sprintf("%s/movie/%s/%s/%s%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, fmt.Sprint(movie.ID), containerExtension(movie.ContainerExtension))
+			if c.filterTrack(&track) {
+				tracks = append(tracks, track)
 			}
+		}
+	}
 
-			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, prefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.ID), extension)
-			playlist.Tracks = append(playlist.Tracks, track)
+	return tracks, nil
+}
+
+func (c *Config) xtreamSeriesTracks(api xtreamActions, tracks []m3u.Track) ([]m3u.Track, error) {
+	cat, err := api.categories("get_series_categories")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, category := range cat {
+		group, ok := c.Filter.Group(category.Name)
+		if !ok || !c.XtreamM3uSeries.Include(category.Name) {
+			continue
+		}
+
+		all, err := api.series(fmt.Sprint(category.ID))
+		if err != nil {
+			return nil, err
+		}
+		series := make([]xtream.SeriesInfo, 0, len(all))
+		for _, serie := range all {
+			if serie.Name, ok = c.Filter.Name(serie.Name); ok {
+				series = append(series, serie)
+			}
+		}
+
+		// one get_series_info request per serie, keep the order
+		episodes := make([][]m3u.Track, len(series))
+		errs := make([]error, len(series))
+		sem := make(chan struct{}, xtreamSeriesInfoWorkers)
+		var wg sync.WaitGroup
+		for i := range series {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				episodes[i], errs[i] = c.xtreamEpisodeTracks(api, &series[i], group)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range series {
+			if errs[i] != nil {
+				log.Printf("[iptv-proxy] %v | xtream serie %q: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), series[i].Name, errs[i])
+				continue
+			}
+			tracks = append(tracks, episodes[i]...)
 		}
 	}
 
-	return playlist, nil
+	return tracks, nil
+}
+
+func (c *Config) xtreamEpisodeTracks(api xtreamActions, serie *xtream.SeriesInfo, category string) ([]m3u.Track, error) {
+	info, err := api.seriesInfo(fmt.Sprint(serie.SeriesID))
+	if err != nil {
+		return nil, err
+	}
+
+	seasons := make([]string, 0, len(info.Episodes))
+	for season := range info.Episodes {
+		seasons = append(seasons, season)
+	}
+	sort.Slice(seasons, func(i, j int) bool {
+		a, errA := strconv.Atoi(seasons[i])
+		b, errB := strconv.Atoi(seasons[j])
+		if errA != nil || errB != nil {
+			return seasons[i] < seasons[j]
+		}
+		return a < b
+	})
+
+	tracks := make([]m3u.Track, 0)
+	for _, season := range seasons {
+		for _, episode := range info.Episodes[season] {
+			name := fmt.Sprintf("%s S%02dE%02d", serie.Name, int(episode.Season), int(episode.EpisodeNum))
+			logo := episode.Info.MovieImage
+			if logo == "" {
+				logo = serie.Cover
+			}
+
+			track := m3u.Track{Name: name, Length: -1}
+			if episode.Info.DurationSecs > 0 {
+				track.Length = int(episode.Info.DurationSecs)
+			}
+			track.Tags = xtreamTrackTags(nil, name, logo, category)
+			track.URI = fmt.Sprintf("%s/series/%s/%s/%s%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, episode.ID, containerExtension(episode.ContainerExtension))
+			tracks = append(tracks, track)
+		}
+	}
+
+	return tracks, nil
+}
+
+func xtreamTrackTags(tags []m3u.Tag, name, logo, group string) []m3u.Tag {
+	if name != "" {
+		tags = append(tags, m3u.Tag{Name: "tvg-name", Value: name})
+	}
+	if logo != "" {
+		tags = append(tags, m3u.Tag{Name: "tvg-logo", Value: logo})
+	}
+	if group != "" {
+		tags = append(tags, m3u.Tag{Name: "group-title", Value: group})
+	}
+
+	return tags
+}
+
+func containerExtension(ext string) string {
+	if ext == "" {
+		return ""
+	}
+
+	return "." + strings.TrimPrefix(ext, ".")
 }
 
 func (c *Config) xtreamGetAuto(ctx *gin.Context) {
@@ -167,12 +450,7 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
 		log.Printf("[iptv-proxy] %v | %s | xtream cache m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
 		xtreamM3uCacheLock.RUnlock()
-		playlist, err := m3u.Parse(m3uURL.String())
-		if err != nil {
-			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-			return
-		}
-		if err := c.cacheXtreamM3u(&playlist, m3uURL.String()); err != nil {
+		if err := c.cacheXtreamM3uURL(ctx.Request.Context(), m3uURL.String(), m3uURL.String()); err != nil {
 			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
@@ -186,7 +464,7 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 	xtreamM3uCacheLock.RUnlock()
 	ctx.Header("Content-Type", "application/octet-stream")
 
-	ctx.File(path)
+	c.serveM3UFile(ctx, path)
 }
 
 func (c *Config) xtreamApiGet(ctx *gin.Context) {
@@ -224,7 +502,7 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 	xtreamM3uCacheLock.RUnlock()
 	ctx.Header("Content-Type", "application/octet-stream")
 
-	ctx.File(path)
+	c.serveM3UFile(ctx, path)
 
 }
 
@@ -254,17 +532,22 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 		action = q["action"][0]
 	}
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
-	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	if resp, ok := c.dvrXtreamAction(action, q); ok {
+		ctx.JSON(http.StatusOK, resp)
 		return
 	}
 
-	resp, httpcode, err := client.Action(c.ProxyConfig, action, q)
+	resp, httpcode, err := c.xtreamAPI.Action(ctx.Request.Context(), ctx.Request.UserAgent(), action, q)
 	if err != nil {
 		_ = ctx.AbortWithError(httpcode, err) // nolint: errcheck
 		return
 	}
+	resp = c.dvrXtreamResponse(action, q, c.filterXtreamResponse(ctx, action, resp))
+	if login, ok := resp.(xtreamapi.Login); ok {
+		// the credentials of the app, not the main user ones
+		login.UserInfo.Username, login.UserInfo.Password = q.Get("username"), q.Get("password")
+		resp = login
+	}
 
 	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
 
@@ -277,22 +560,14 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 }
 
 func (c *Config) xtreamXMLTV(ctx *gin.Context) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
-	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
-	}
+	c.serveEPG(ctx)
+}
 
-	resp, err := client.GetXMLTV()
-	if err != nil {
-		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
+	if c.serveXtreamCatchup(ctx) {
 		return
 	}
 
-	ctx.Data(http.StatusOK, "application/xml", resp)
-}
-
-func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
 	id := ctx.Param("id")
 	rpURL, err := url.Parse(fmt.Sprintf("%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
@@ -304,7 +579,15 @@ func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamStreamLive(ctx *gin.Context) {
+	if c.serveXtreamCatchup(ctx) {
+		return
+	}
+
 	id := ctx.Param("id")
+	if c.serveTimeshift(ctx, id) {
+		return
+	}
+
 	rpURL, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -340,6 +623,10 @@ func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
+	if c.serveRecording(ctx) {
+		return
+	}
+
 	id := ctx.Param("id")
 	rpURL, err := url.Parse(fmt.Sprintf("%s/movie/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
 	if err != nil {
@@ -347,7 +634,7 @@ func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.serveVOD(ctx, "movie", rpURL)
 }
 
 func (c *Config) xtreamStreamSeries(ctx *gin.Context) {
@@ -358,7 +645,7 @@ func (c *Config) xtreamStreamSeries(ctx *gin.Context) {
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	c.serveVOD(ctx, "series", rpURL)
 }
 
 func (c *Config) xtreamHlsStream(ctx *gin.Context) {
@@ -411,7 +698,7 @@ func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 			"%s://%s/hlsr/%s/%s/%s/%s/%s/%s",
 			redirectURL.Scheme,
 			redirectURL.Host,
-			ctx.Param("token"),
+			ctx.Param("hlsrToken"),
 			c.XtreamUser,
 			c.XtreamPassword,
 			ctx.Param("channel"),
@@ -499,9 +786,20 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 				return
 			}
 			body := string(b)
-			body = strings.ReplaceAll(body, "/"+c.XtreamUser.String()+"/"+c.XtreamPassword.String()+"/", "/"+c.User.String()+"/"+c.Password.String()+"/")
+			body = strings.ReplaceAll(body, "/"+c.XtreamUser.PathEscape()+"/"+c.XtreamPassword.PathEscape()+"/", "/"+c.User.PathEscape()+"/"+c.Password.PathEscape()+"/")
+
+			// the segment URLs of the request user
+			if rewrite := c.userURLs(ctx); rewrite != nil {
+				var out bytes.Buffer
+				if err := rewritePlaylist(&out, strings.NewReader(body), rewrite, "", ""); err != nil {
+					_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+					return
+				}
+				body = out.String()
+			}
 
 			mergeHttpHeader(ctx.Writer.Header(), hlsResp.Header)
+			ctx.Writer.Header().Del("Content-Length")
 
 			ctx.Data(http.StatusOK, hlsResp.Header.Get("Content-Type"), []byte(body))
 			return
@@ -0,0 +1,422 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buga1234/iptv-proxy/pkg/config"
+	"github.com/buga1234/iptv-proxy/pkg/m3u"
+	"github.com/gin-gonic/gin"
+)
+
+// Local Xtream server: the Xtream client API emulated on top of the m3u playlist.
+// Stream ids are the track indexes + 1, category ids the group indexes + 1.
+
+const xtreamTimeLayout = "2006-01-02 15:04:05"
+
+type localUserInfo struct {
+	Username             string   `json:"username"`
+	Password             string   `json:"password"`
+	Message              string   `json:"message"`
+	Auth                 int      `json:"auth"`
+	Status               string   `json:"status"`
+	ExpDate              *string  `json:"exp_date"`
+	IsTrial              string   `json:"is_trial"`
+	ActiveConnections    string   `json:"active_cons"`
+	CreatedAt            string   `json:"created_at"`
+	MaxConnections       string   `json:"max_connections"`
+	AllowedOutputFormats []string `json:"allowed_output_formats"`
+}
+
+type localServerInfo struct {
+	URL          string `json:"url"`
+	Port         string `json:"port"`
+	HTTPSPort    string `json:"https_port"`
+	Protocol     string `json:"server_protocol"`
+	RTMPPort     string `json:"rtmp_port"`
+	Timezone     string `json:"timezone"`
+	TimestampNow int64  `json:"timestamp_now"`
+	TimeNow      string `json:"time_now"`
+}
+
+type localLogin struct {
+	UserInfo   localUserInfo   `json:"user_info"`
+	ServerInfo localServerInfo `json:"server_info"`
+}
+
+type localCategory struct {
+	ID       string `json:"category_id"`
+	Name     string `json:"category_name"`
+	ParentID int    `json:"parent_id"`
+}
+
+type localStream struct {
+	Num               int    `json:"num"`
+	Name              string `json:"name"`
+	StreamType        string `json:"stream_type"`
+	ID                int    `json:"stream_id"`
+	Icon              string `json:"stream_icon"`
+	EPGChannelID      string `json:"epg_channel_id"`
+	Added             string `json:"added"`
+	CategoryID        string `json:"category_id"`
+	CustomSid         string `json:"custom_sid"`
+	TVArchive         int    `json:"tv_archive"`
+	DirectSource      string `json:"direct_source"`
+	TVArchiveDuration int    `json:"tv_archive_duration"`
+}
+
+type localEPGListing struct {
+	ID             string `json:"id"`
+	EPGID          string `json:"epg_id"`
+	Title          string `json:"title"`
+	Lang           string `json:"lang"`
+	Start          string `json:"start"`
+	End            string `json:"end"`
+	Description    string `json:"description"`
+	ChannelID      string `json:"channel_id"`
+	StartTimestamp string `json:"start_timestamp"`
+	StopTimestamp  string `json:"stop_timestamp"`
+	NowPlaying     int    `json:"now_playing"`
+	HasArchive     int    `json:"has_archive"`
+}
+
+type localEPG struct {
+	Listings []localEPGListing `json:"epg_listings"`
+}
+
+func (c *Config) localXtreamRoutes(r *gin.RouterGroup) {
+	// m3uRoutes already serves the playlist under that name
+	if c.M3UFileName != "get.php" {
+		r.GET("/get.php", c.authenticate, c.getM3U)
+		r.POST("/get.php", c.authenticate, c.getM3U)
+	}
+	r.GET("/player_api.php", c.authenticate, c.localXtreamPlayerAPIGET)
+	r.POST("/player_api.php", c.appAuthenticate, c.localXtreamPlayerAPIPOST)
+	if c.epg != nil {
+		r.GET("/xmltv.php", c.authenticate, c.serveEPG)
+	}
+	c.streamRoute(r, "/live/%s/%s/:id", c.localXtreamStreamLive)
+	c.streamRoute(r, "/timeshift/%s/%s/:duration/:start/:id", c.localXtreamStreamTimeshift)
+}
+
+func (c *Config) localXtreamPlayerAPIGET(ctx *gin.Context) {
+	c.localXtreamPlayerAPI(ctx, ctx.Request.URL.Query())
+}
+
+func (c *Config) localXtreamPlayerAPIPOST(ctx *gin.Context) {
+	contents, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	q, err := url.ParseQuery(string(contents))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	c.localXtreamPlayerAPI(ctx, q)
+}
+
+func (c *Config) localXtreamPlayerAPI(ctx *gin.Context, q url.Values) {
+	action := q.Get("action")
+
+	log.Printf("[iptv-proxy] %v | %s |Local action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+
+	var resp interface{}
+	switch action {
+	case "get_live_categories":
+		resp = c.localLiveCategories(requestUser(ctx))
+	case "get_live_streams":
+		resp = c.localLiveStreams(requestUser(ctx), q.Get("category_id"))
+	case "get_short_epg", "get_simple_data_table":
+		streamID, err := strconv.Atoi(q.Get("stream_id"))
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid %q", "stream_id")) // nolint: errcheck
+			return
+		}
+		limit := 0
+		if action == "get_short_epg" {
+			limit = 4
+			if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+				limit = l
+			}
+		}
+		resp = c.localEPG(streamID, limit)
+	case "get_vod_categories", "get_vod_streams", "get_vod_info":
+		var ok bool
+		if resp, ok = c.dvrXtreamAction(action, q); !ok {
+			resp = c.dvrXtreamResponse(action, q, []struct{}{})
+		}
+	case "get_series_categories", "get_series":
+		resp = []struct{}{}
+	default:
+		resp = c.localLogin(q)
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// localLogin returns the login response, with the credentials of the app.
+func (c *Config) localLogin(q url.Values) localLogin {
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+	now := time.Now().In(c.localLocation())
+	port := strconv.Itoa(c.AdvertisedPort)
+
+	return localLogin{
+		UserInfo: localUserInfo{
+			Username:             q.Get("username"),
+			Password:             q.Get("password"),
+			Auth:                 1,
+			Status:               "Active",
+			IsTrial:              "0",
+			ActiveConnections:    "0",
+			CreatedAt:            strconv.FormatInt(now.Unix(), 10),
+			MaxConnections:       "1",
+			AllowedOutputFormats: []string{"m3u8", "ts"},
+		},
+		ServerInfo: localServerInfo{
+			URL:          protocol + "://" + c.HostConfig.Hostname,
+			Port:         port,
+			HTTPSPort:    port,
+			Protocol:     protocol,
+			RTMPPort:     port,
+			Timezone:     now.Location().String(),
+			TimestampNow: now.Unix(),
+			TimeNow:      now.Format(xtreamTimeLayout),
+		},
+	}
+}
+
+// trackGroup returns the group of a track, from its group-title tag or #EXTGRP.
+func trackGroup(track *m3u.Track) string {
+	if group := track.Tag("group-title"); group != "" {
+		return group
+	}
+
+	return track.Group
+}
+
+// localCategoryIDs returns the category id of each group, in playlist order.
+func (c *Config) localCategoryIDs() (map[string]string, []string) {
+	ids := map[string]string{}
+	var groups []string
+	for i := range c.playlist.Tracks {
+		group := trackGroup(&c.playlist.Tracks[i])
+		if _, ok := ids[group]; ok {
+			continue
+		}
+		ids[group] = strconv.Itoa(len(groups) + 1)
+		groups = append(groups, group)
+	}
+
+	return ids, groups
+}
+
+func (c *Config) localLiveCategories(user *config.UserAccount) []localCategory {
+	ids, groups := c.localCategoryIDs()
+
+	categories := make([]localCategory, 0, len(groups))
+	for _, group := range groups {
+		if user.Hides(group) {
+			continue
+		}
+		categories = append(categories, localCategory{ID: ids[group], Name: group})
+	}
+
+	return categories
+}
+
+func (c *Config) localLiveStreams(user *config.UserAccount, categoryID string) []localStream {
+	ids, _ := c.localCategoryIDs()
+
+	streams := make([]localStream, 0, len(c.playlist.Tracks))
+	for i := range c.playlist.Tracks {
+		track := &c.playlist.Tracks[i]
+		group := trackGroup(track)
+		catID := ids[group]
+		if (categoryID != "" && categoryID != catID) || user.Hides(group) {
+			continue
+		}
+
+		epgChannelID := track.Tag("tvg-id")
+		if c.epg != nil {
+			if id := c.epg.ChannelID(epgChannelID, track.Name); id != "" {
+				epgChannelID = id
+			}
+		}
+
+		num := i + 1
+		if chno, err := strconv.Atoi(track.Tag("tvg-chno")); err == nil {
+			num = chno
+		}
+
+		archive := 0
+		days := catchupDays(track)
+		if days > 0 {
+			archive = 1
+		}
+
+		streams = append(streams, localStream{
+			Num:               num,
+			Name:              track.Name,
+			StreamType:        "live",
+			ID:                i + 1,
+			Icon:              c.imageURL(track.Tag("tvg-logo")),
+			EPGChannelID:      epgChannelID,
+			Added:             "0",
+			CategoryID:        catID,
+			TVArchive:         archive,
+			TVArchiveDuration: days,
+		})
+	}
+
+	return streams
+}
+
+func (c *Config) localEPG(streamID, limit int) localEPG {
+	ret := localEPG{Listings: []localEPGListing{}}
+
+	track, err := c.localTrack(streamID)
+	if err != nil || c.epg == nil {
+		return ret
+	}
+
+	channelID := c.epg.ChannelID(track.Tag("tvg-id"), track.Name)
+	if channelID == "" {
+		return ret
+	}
+
+	now := time.Now()
+	for i, l := range c.epg.Listings(channelID, now, limit) {
+		nowPlaying := 0
+		if !l.Start.After(now) {
+			nowPlaying = 1
+		}
+		ret.Listings = append(ret.Listings, localEPGListing{
+			ID:             strconv.FormatInt(l.Start.Unix(), 10),
+			EPGID:          strconv.Itoa(i),
+			Title:          base64.StdEncoding.EncodeToString([]byte(l.Title)),
+			Start:          l.Start.In(c.localLocation()).Format(xtreamTimeLayout),
+			End:            l.Stop.In(c.localLocation()).Format(xtreamTimeLayout),
+			Description:    base64.StdEncoding.EncodeToString([]byte(l.Description)),
+			ChannelID:      channelID,
+			StartTimestamp: strconv.FormatInt(l.Start.Unix(), 10),
+			StopTimestamp:  strconv.FormatInt(l.Stop.Unix(), 10),
+			NowPlaying:     nowPlaying,
+		})
+	}
+
+	return ret
+}
+
+// localTrack returns the track of a local stream id.
+func (c *Config) localTrack(streamID int) (*m3u.Track, error) {
+	if streamID < 1 || streamID > len(c.playlist.Tracks) {
+		return nil, errors.New("stream not found")
+	}
+
+	return &c.playlist.Tracks[streamID-1], nil
+}
+
+func (c *Config) localXtreamStreamLive(ctx *gin.Context) {
+	id := ctx.Param("id")
+	streamID, err := strconv.Atoi(strings.TrimSuffix(id, path.Ext(id)))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	track, err := c.localTrack(streamID)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+
+	if c.serveTrackCatchup(ctx, track) {
+		return
+	}
+	if c.serveTimeshift(ctx, id) {
+		return
+	}
+
+	// HLS tracks go through the m3u8 proxy route.
+	if strings.HasSuffix(track.URI, ".m3u8") {
+		uri, err := c.replaceURL(track.URI, streamID-1, false)
+		if err != nil {
+			_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		ctx.Redirect(http.StatusFound, c.publicURL(ctx, uri))
+		return
+	}
+
+	rpURL, err := url.Parse(track.URI)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	c.stream(ctx, rpURL)
+}
+
+// localXtreamStreamTimeshift serves the xtream timeshift URLs
+// (/timeshift/user/pass/<minutes>/<YYYY-MM-DD:HH-MM>/<id>.ts) from the track catch-up.
+func (c *Config) localXtreamStreamTimeshift(ctx *gin.Context) {
+	id := ctx.Param("id")
+	streamID, err := strconv.Atoi(strings.TrimSuffix(id, path.Ext(id)))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	minutes, err := strconv.Atoi(ctx.Param("duration"))
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	start, err := time.ParseInLocation("2006-01-02:15-04", ctx.Param("start"), c.localLocation())
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	track, err := c.localTrack(streamID)
+	if err != nil {
+		_ = ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+
+	c.streamTrackCatchup(ctx, track, catchupWindow{start: start, duration: time.Duration(minutes) * time.Minute})
+}
@@ -0,0 +1,150 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package ssdp announces an UPnP device on the LAN.
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	multicastAddr = "239.255.255.250:1900"
+	maxAge        = 1800
+	serverName    = "Linux/3.x UPnP/1.0 iptv-proxy/1.0"
+)
+
+// Device is an UPnP device to announce.
+type Device struct {
+	// Location is the URL of the device description (device.xml).
+	Location string
+	// UUID is the device unique id, without the "uuid:" prefix.
+	UUID string
+	// Types are the device and service types, e.g. "urn:schemas-upnp-org:device:MediaServer:1".
+	Types []string
+}
+
+// notificationTypes returns all the NT/ST values the device answers to.
+func (d *Device) notificationTypes() []string {
+	return append([]string{"upnp:rootdevice", "uuid:" + d.UUID}, d.Types...)
+}
+
+func (d *Device) usn(nt string) string {
+	if nt == "uuid:"+d.UUID {
+		return nt
+	}
+
+	return "uuid:" + d.UUID + "::" + nt
+}
+
+// Announce answers M-SEARCH requests and periodically sends alive
+// notifications until ctx is done, then sends byebye notifications.
+func Announce(ctx context.Context, d *Device) error {
+	group, err := net.ResolveUDPAddr("udp4", multicastAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		d.notify(conn, group, "ssdp:byebye")
+		_ = conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(maxAge / 2 * time.Second)
+		defer ticker.Stop()
+		for {
+			d.notify(conn, group, "ssdp:alive")
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		d.answer(conn, from, buf[:n])
+	}
+}
+
+// answer replies to an M-SEARCH request.
+func (d *Device) answer(conn *net.UDPConn, from *net.UDPAddr, packet []byte) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+		return
+	}
+
+	st := req.Header.Get("St")
+	for _, nt := range d.notificationTypes() {
+		if st != "ssdp:all" && !strings.EqualFold(st, nt) {
+			continue
+		}
+
+		resp := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n"+
+			"\r\n", maxAge, d.Location, serverName, nt, d.usn(nt))
+		if _, err := conn.WriteToUDP([]byte(resp), from); err != nil {
+			log.Printf("[iptv-proxy] %v | SSDP: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+			return
+		}
+	}
+}
+
+// notify multicasts an alive or byebye notification for each notification type.
+func (d *Device) notify(conn *net.UDPConn, group *net.UDPAddr, nts string) {
+	for _, nt := range d.notificationTypes() {
+		msg := fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+			"HOST: %s\r\n"+
+			"CACHE-CONTROL: max-age=%d\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: %s\r\n"+
+			"NT: %s\r\n"+
+			"NTS: %s\r\n"+
+			"USN: %s\r\n"+
+			"\r\n", multicastAddr, maxAge, d.Location, serverName, nt, nts, d.usn(nt))
+		_, _ = conn.WriteToUDP([]byte(msg), group)
+	}
+}
@@ -0,0 +1,422 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package timeshift keeps the last minutes of the watched live channels
+// on disk, as HLS segments, so they can be paused and rewound.
+package timeshift
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// SegmentDuration is the target duration of the segments.
+	SegmentDuration = 6 * time.Second
+	// wait for the first segment of a new buffer
+	startTimeout = 30 * time.Second
+	retryDelay   = 5 * time.Second
+)
+
+// ErrNotReady is returned when a new buffer has no segment in time.
+var ErrNotReady = errors.New("timeshift: no segment received")
+
+// OpenFunc opens the MPEG-TS live stream of a channel.
+type OpenFunc func(ctx context.Context, channel string) (io.ReadCloser, error)
+
+// Sessions provide the buffers directories, and stop the buffers
+// nobody watches anymore.
+type Sessions interface {
+	Open(id string, stop func()) (string, error)
+	Touch(id string) bool
+	Close(id string)
+}
+
+// Buffers are the rolling buffers of the watched channels.
+type Buffers struct {
+	sessions Sessions
+	window   time.Duration
+	open     OpenFunc
+
+	mu      sync.Mutex
+	buffers map[string]*buffer
+}
+
+type segment struct {
+	name          string
+	duration      time.Duration
+	date          time.Time
+	discontinuity bool
+}
+
+type buffer struct {
+	channel string
+	dir     string
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	mu sync.Mutex
+	// media sequence of segments[0]
+	sequence int
+	// dropped discontinuities, for EXT-X-DISCONTINUITY-SEQUENCE
+	discontinuities int
+	segments        []segment
+	next            int
+	err             error
+}
+
+// New returns the buffers of the channels, kept for window in sessions
+// directories. The upstream streams are opened with open.
+func New(sessions Sessions, window time.Duration, open OpenFunc) *Buffers {
+	return &Buffers{
+		sessions: sessions,
+		window:   window,
+		open:     open,
+		buffers:  make(map[string]*buffer),
+	}
+}
+
+// session is the session id of a channel buffer.
+func session(channel string) string {
+	return "timeshift-" + channel
+}
+
+// Playlist returns the HLS playlist of a channel buffer, started if needed.
+// The segments URLs are relative to the playlist.
+func (b *Buffers) Playlist(ctx context.Context, channel string) ([]byte, error) {
+	buf, err := b.buffer(channel)
+	if err != nil {
+		return nil, err
+	}
+	b.sessions.Touch(session(channel))
+
+	timer := time.NewTimer(startTimeout)
+	defer timer.Stop()
+	select {
+	case <-buf.ready:
+	case <-timer.C:
+		return nil, ErrNotReady
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	buf.mu.Lock()
+	err = buf.err
+	buf.mu.Unlock()
+	if err != nil {
+		b.drop(channel, buf)
+		return nil, err
+	}
+
+	return buf.playlist(), nil
+}
+
+// Segment returns the path of a segment of a channel buffer.
+func (b *Buffers) Segment(channel, name string) (string, error) {
+	b.mu.Lock()
+	buf := b.buffers[channel]
+	b.mu.Unlock()
+	if buf == nil || !b.sessions.Touch(session(channel)) {
+		return "", os.ErrNotExist
+	}
+
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	for _, s := range buf.segments {
+		if s.name == name {
+			return filepath.Join(buf.dir, name), nil
+		}
+	}
+
+	return "", os.ErrNotExist
+}
+
+func (b *Buffers) buffer(channel string) (*buffer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// stopped buffers are replaced
+	if buf := b.buffers[channel]; buf != nil && buf.ctx.Err() == nil {
+		return buf, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dir, err := b.sessions.Open(session(channel), cancel)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	buf := &buffer{
+		channel: channel,
+		dir:     dir,
+		ctx:     ctx,
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+	}
+	b.buffers[channel] = buf
+	go b.run(ctx, buf)
+
+	return buf, nil
+}
+
+func (b *Buffers) drop(channel string, buf *buffer) {
+	b.mu.Lock()
+	current := b.buffers[channel] == buf
+	if current {
+		delete(b.buffers, channel)
+	}
+	b.mu.Unlock()
+
+	if current {
+		b.sessions.Close(session(channel))
+	}
+}
+
+// run records the channel until the buffer is stopped, reconnecting
+// when the stream drops once the first segment is recorded.
+func (b *Buffers) run(ctx context.Context, buf *buffer) {
+	discontinuity := false
+	for ctx.Err() == nil {
+		r, err := b.open(ctx, buf.channel)
+		if err == nil {
+			err = b.record(ctx, buf, r, discontinuity)
+			_ = r.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !buf.started() {
+			buf.fail(err)
+			return
+		}
+
+		log.Printf("[iptv-proxy] %v | timeshift: %s: %v, reconnecting\n", time.Now().Format("2006/01/02 - 15:04:05"), buf.channel, err)
+		discontinuity = true
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// record cuts the stream in segments starting on key frames, each one
+// starting with the program tables so it can be decoded alone.
+func (b *Buffers) record(ctx context.Context, buf *buffer, r io.Reader, discontinuity bool) error {
+	in := bufio.NewReaderSize(r, 256*packetSize)
+	p := make(packet, packetSize)
+
+	var (
+		pat      []byte
+		pmt      = make(map[uint16][]byte)
+		programs = make(map[uint16]bool)
+
+		out      *os.File
+		name     string
+		start    time.Time
+		startPTS int64 = -1
+	)
+	defer func() {
+		// the segment in progress is incomplete
+		if out != nil {
+			_ = out.Close()
+			_ = os.Remove(filepath.Join(buf.dir, name))
+		}
+	}()
+
+	connected := time.Now()
+	for {
+		if err := readPacket(in, p); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		switch pid := p.pid(); {
+		case pid == 0:
+			pat = append(pat[:0], p...)
+			for _, program := range p.programs() {
+				programs[program] = true
+			}
+		case programs[pid]:
+			pmt[pid] = append(pmt[pid][:0], p...)
+		}
+
+		now := time.Now()
+		key := p.randomAccess() && p.unitStart()
+		pts, hasPTS := p.pts()
+
+		var cut bool
+		var duration time.Duration
+		switch {
+		case out == nil:
+			// start on a key frame, streams not flagging them on any packet
+			cut = key || now.Sub(connected) > SegmentDuration
+		case key && hasPTS && startPTS >= 0:
+			if duration = ptsDuration(startPTS, pts); duration >= SegmentDuration {
+				cut = true
+				// timestamps jump, trust the clock
+				if duration > 3*SegmentDuration {
+					duration = now.Sub(start)
+				}
+			}
+		case now.Sub(start) > 3*SegmentDuration:
+			cut, duration = true, now.Sub(start)
+		}
+
+		if cut {
+			if out != nil {
+				if err := out.Close(); err != nil {
+					return err
+				}
+				out = nil
+				b.publish(buf, segment{name: name, duration: duration, date: start, discontinuity: discontinuity})
+				discontinuity = false
+			}
+
+			name = buf.nextName()
+			f, err := os.Create(filepath.Join(buf.dir, name))
+			if err != nil {
+				return err
+			}
+			out, start, startPTS = f, now, -1
+			if key && hasPTS {
+				startPTS = pts
+			}
+
+			var tables bytes.Buffer
+			tables.Write(pat)
+			for pid := range programs {
+				tables.Write(pmt[pid])
+			}
+			if _, err := out.Write(tables.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		if out == nil {
+			continue // waiting for a key frame
+		}
+		if _, err := out.Write(p); err != nil {
+			return err
+		}
+	}
+}
+
+// publish adds a recorded segment and removes the ones out of the window.
+func (b *Buffers) publish(buf *buffer, s segment) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	buf.segments = append(buf.segments, s)
+
+	var total time.Duration
+	for _, s := range buf.segments {
+		total += s.duration
+	}
+	for len(buf.segments) > 1 && total-buf.segments[0].duration >= b.window {
+		old := buf.segments[0]
+		total -= old.duration
+		if old.discontinuity {
+			buf.discontinuities++
+		}
+		_ = os.Remove(filepath.Join(buf.dir, old.name))
+		buf.segments = buf.segments[1:]
+		buf.sequence++
+	}
+
+	buf.readyOnce.Do(func() { close(buf.ready) })
+}
+
+func (buf *buffer) nextName() string {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	buf.next++
+
+	return fmt.Sprintf("%d.ts", buf.next)
+}
+
+func (buf *buffer) started() bool {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	return len(buf.segments) > 0
+}
+
+func (buf *buffer) fail(err error) {
+	if err == nil {
+		err = ErrNotReady
+	}
+	buf.mu.Lock()
+	buf.err = err
+	buf.mu.Unlock()
+
+	buf.readyOnce.Do(func() { close(buf.ready) })
+}
+
+// playlist is a live playlist with a sliding window, players may seek
+// anywhere in it. It has no EVENT playlist type since its first segments
+// go away as it grows.
+func (buf *buffer) playlist() []byte {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	target := SegmentDuration
+	for _, s := range buf.segments {
+		if s.duration > target {
+			target = s.duration
+		}
+	}
+
+	var w bytes.Buffer
+	fmt.Fprintln(&w, "#EXTM3U")
+	fmt.Fprintln(&w, "#EXT-X-VERSION:3")
+	fmt.Fprintf(&w, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&w, "#EXT-X-MEDIA-SEQUENCE:%d\n", buf.sequence)
+	if buf.discontinuities > 0 {
+		fmt.Fprintf(&w, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", buf.discontinuities)
+	}
+	for _, s := range buf.segments {
+		if s.discontinuity {
+			fmt.Fprintln(&w, "#EXT-X-DISCONTINUITY")
+		}
+		fmt.Fprintf(&w, "#EXT-X-PROGRAM-DATE-TIME:%s\n", s.date.UTC().Format("2006-01-02T15:04:05.000Z"))
+		fmt.Fprintf(&w, "#EXTINF:%.3f,\n%s\n", s.duration.Seconds(), s.name)
+	}
+
+	return w.Bytes()
+}
@@ -0,0 +1,127 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package timeshift
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+const (
+	packetSize = 188
+	syncByte   = 0x47
+	// PTS clock rate
+	ptsRate = 90000
+)
+
+// packet is an MPEG-TS packet.
+type packet []byte
+
+func (p packet) pid() uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+func (p packet) unitStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p packet) payload() []byte {
+	control := p[3] >> 4 & 0x3
+	if control&0x1 == 0 {
+		return nil
+	}
+	offset := 4
+	if control&0x2 != 0 {
+		offset += 1 + int(p[4])
+	}
+	if offset >= packetSize {
+		return nil
+	}
+
+	return p[offset:]
+}
+
+// randomAccess reports whether the packet starts a key frame.
+func (p packet) randomAccess() bool {
+	return p[3]&0x20 != 0 && p[4] > 0 && p[5]&0x40 != 0
+}
+
+// pts returns the presentation timestamp of the PES starting in the packet.
+func (p packet) pts() (int64, bool) {
+	pes := p.payload()
+	if !p.unitStart() || len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[7]&0x80 == 0 {
+		return 0, false
+	}
+	b := pes[9:14]
+
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1), true
+}
+
+// programs returns the PMT PIDs of a PAT packet.
+func (p packet) programs() []uint16 {
+	data := p.payload()
+	if !p.unitStart() || len(data) == 0 || 1+int(data[0]) >= len(data) {
+		return nil
+	}
+	section := data[1+int(data[0]):]
+	if len(section) < 8 || section[0] != 0 {
+		return nil
+	}
+	// without the CRC
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2])) - 4
+	if end > len(section) {
+		end = len(section)
+	}
+
+	var pids []uint16
+	for i := 8; i+4 <= end; i += 4 {
+		if section[i] == 0 && section[i+1] == 0 {
+			continue // network PID
+		}
+		pids = append(pids, uint16(section[i+2]&0x1f)<<8|uint16(section[i+3]))
+	}
+
+	return pids
+}
+
+// readPacket reads the next packet, skipping garbage until a sync byte.
+func readPacket(r *bufio.Reader, p packet) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != syncByte {
+			continue
+		}
+		p[0] = b
+		_, err = io.ReadFull(r, p[1:])
+
+		return err
+	}
+}
+
+// ptsDuration returns the duration between two timestamps,
+// 33 bits wrapping.
+func ptsDuration(from, to int64) time.Duration {
+	ticks := (to - from) & (1<<33 - 1)
+
+	return time.Duration(ticks) * time.Second / ptsRate
+}
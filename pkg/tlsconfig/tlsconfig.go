@@ -0,0 +1,203 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package tlsconfig provides the TLS configuration of the proxy, its
+// certificate and client CAs being reloaded when their files change.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const reloadInterval = 10 * time.Second
+
+// Reloader holds the certificate and the client CAs loaded from files.
+type Reloader struct {
+	certFile, keyFile, clientCAFile string
+	clientAuth                      tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+}
+
+// New loads a certificate and its key, and the CAs of the client
+// certificates if clientCAFile isn't empty: they are required with
+// requireClientCert, verified when given otherwise.
+func New(certFile, keyFile, clientCAFile string, requireClientCert bool) (*Reloader, error) {
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		clientAuth:   tls.NoClientCert,
+	}
+	switch {
+	case clientCAFile != "" && requireClientCert:
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	case clientCAFile != "":
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	case requireClientCert:
+		return nil, errors.New("tlsconfig: client certificates required without client CA")
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Config returns the TLS configuration, using the last loaded files.
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   r.clientAuth,
+				ClientCAs:    r.clientCAs,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// Run reloads the files when they change, until ctx is done. The
+// previous ones are kept while the new ones are invalid.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Printf("[iptv-proxy] %v | tls: %v, keeping the previous certificate\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+			// retried on the next change
+			r.stamp()
+			continue
+		}
+		log.Printf("[iptv-proxy] %v | tls: certificate reloaded\n", time.Now().Format("2006/01/02 - 15:04:05"))
+	}
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+
+	return files
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for i, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			// being replaced
+			return false
+		}
+		if !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Reloader) modTimesNow() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	return modTimes, nil
+}
+
+func (r *Reloader) stamp() {
+	modTimes, err := r.modTimesNow()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.modTimes = modTimes
+	r.mu.Unlock()
+}
+
+func (r *Reloader) load() error {
+	modTimes, err := r.modTimesNow()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("tlsconfig: no certificate in " + r.clientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.clientCAs, r.modTimes = &cert, clientCAs, modTimes
+	r.mu.Unlock()
+
+	return nil
+}
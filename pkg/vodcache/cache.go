@@ -0,0 +1,564 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package vodcache keeps movies and series episodes on disk, by chunks
+// fetched with range requests as they are watched.
+package vodcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChunkSize is the size of the ranges requested to the provider.
+const ChunkSize = 8 << 20
+
+// chunks fetched ahead of the reader
+const prefetchChunks = 4
+
+const metaFile = "meta.json"
+
+// ErrNoRange is returned by Open when the provider doesn't support
+// range requests, the content can't be cached.
+var ErrNoRange = errors.New("range requests not supported")
+
+var client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// Meta describes a cached content.
+type Meta struct {
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	ModTime     time.Time `json:"mod_time"`
+}
+
+type file struct {
+	dir string
+	// upstream URL and user agent of the last Open
+	url       string
+	userAgent string
+
+	meta   Meta
+	chunks map[int64]int64 // index -> size
+	used   time.Time
+	refs   int
+
+	// one provider request at a time per content
+	fetchLock sync.Mutex
+	// readers waiting for fetchLock, the prefetch gives way to them
+	waiting     int32
+	prefetching bool
+}
+
+// Cache stores the contents in a directory, the least recently watched
+// ones are removed beyond the size limit.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	lock  sync.Mutex
+	files map[string]*file
+	total int64
+	// upstream URLs not honouring the range requests
+	noRange map[string]bool
+}
+
+// New returns a cache of at most maxSize bytes (0 for no limit) in dir.
+// Contents already in dir are kept.
+func New(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{dir: dir, maxSize: maxSize, files: map[string]*file{}, noRange: map[string]bool{}}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		f, err := loadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			_ = os.RemoveAll(filepath.Join(dir, e.Name()))
+			continue
+		}
+		c.files[e.Name()] = f
+		for _, size := range f.chunks {
+			c.total += size
+		}
+	}
+	c.evictLocked()
+
+	return c, nil
+}
+
+func loadFile(dir string) (*file, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if err != nil {
+		return nil, err
+	}
+	f := &file{dir: dir, chunks: map[int64]int64{}}
+	if err := json.Unmarshal(data, &f.meta); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".chunk") {
+			if strings.HasPrefix(name, ".") {
+				// interrupted download
+				_ = os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		idx, err := strconv.ParseInt(strings.TrimSuffix(name, ".chunk"), 10, 64)
+		info, ierr := e.Info()
+		if err != nil || ierr != nil || info.Size() != chunkLen(idx, f.meta.Size) {
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		f.chunks[idx] = info.Size()
+		if info.ModTime().After(f.used) {
+			f.used = info.ModTime()
+		}
+	}
+
+	return f, nil
+}
+
+// chunkLen is the expected size of a chunk, of a content of the given size.
+func chunkLen(idx, size int64) int64 {
+	return min64(ChunkSize, size-idx*ChunkSize)
+}
+
+func (f *file) chunkPath(idx int64) string {
+	return filepath.Join(f.dir, strconv.FormatInt(idx, 10)+".chunk")
+}
+
+// Open returns a reader of the content identified by key, available at
+// url. The reader fetches the missing chunks, it must be closed.
+func (c *Cache) Open(ctx context.Context, key, url, userAgent string) (*Reader, error) {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:16])
+
+	c.lock.Lock()
+	if c.noRange[url] {
+		c.lock.Unlock()
+		return nil, ErrNoRange
+	}
+	f := c.files[name]
+	if f == nil {
+		f = &file{dir: filepath.Join(c.dir, name), chunks: map[int64]int64{}}
+		c.files[name] = f
+	}
+	f.url, f.userAgent = url, userAgent
+	f.used = time.Now()
+	f.refs++
+	c.lock.Unlock()
+
+	r := &Reader{c: c, f: f, ctx: ctx}
+	if err := c.init(ctx, f); err != nil {
+		_ = r.Close()
+		if errors.Is(err, ErrNoRange) {
+			c.uncacheable(name, url, f)
+		}
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// uncacheable removes a content the provider doesn't serve by ranges,
+// its URL isn't requested again.
+func (c *Cache) uncacheable(name, url string, f *file) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.noRange[url] = true
+	if f.refs > 0 || len(f.chunks) > 0 || c.files[name] != f {
+		return
+	}
+	if err := os.RemoveAll(f.dir); err != nil {
+		return
+	}
+	delete(c.files, name)
+}
+
+// init fetches the first chunk of a new content, it gives its size.
+func (c *Cache) init(ctx context.Context, f *file) error {
+	f.fetchLock.Lock()
+	defer f.fetchLock.Unlock()
+
+	c.lock.Lock()
+	known := f.meta.Size > 0
+	c.lock.Unlock()
+	if known {
+		return nil
+	}
+
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+
+	return c.fetch(ctx, f, 0)
+}
+
+// chunk returns the path of a chunk, fetching it when needed.
+func (c *Cache) chunk(ctx context.Context, f *file, idx int64) (string, error) {
+	c.lock.Lock()
+	_, ok := f.chunks[idx]
+	c.lock.Unlock()
+	if ok {
+		return f.chunkPath(idx), nil
+	}
+
+	atomic.AddInt32(&f.waiting, 1)
+	f.fetchLock.Lock()
+	atomic.AddInt32(&f.waiting, -1)
+	defer f.fetchLock.Unlock()
+
+	c.lock.Lock()
+	_, ok = f.chunks[idx]
+	c.lock.Unlock()
+	if ok {
+		return f.chunkPath(idx), nil
+	}
+
+	return f.chunkPath(idx), c.fetch(ctx, f, idx)
+}
+
+// fetch downloads a chunk, with fetchLock held.
+// Chunk 0 of a new content also gives the content metadata.
+func (c *Cache) fetch(ctx context.Context, f *file, idx int64) error {
+	c.lock.Lock()
+	url, userAgent, size := f.url, f.userAgent, f.meta.Size
+	c.lock.Unlock()
+
+	start := idx * ChunkSize
+	end := start + ChunkSize - 1
+	if size > 0 {
+		end = start + chunkLen(idx, size) - 1
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			return ErrNoRange
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	meta := Meta{Size: size}
+	if size == 0 {
+		meta.Size, err = contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		meta.ContentType = resp.Header.Get("Content-Type")
+		meta.ModTime = time.Now()
+		if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			meta.ModTime = lastModified
+		}
+		end = start + min64(ChunkSize, meta.Size) - 1
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".chunk")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, end-start+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != end-start+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && size == 0 {
+		err = writeMeta(f.dir, meta)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(f.dir, strconv.FormatInt(idx, 10)+".chunk"))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if size == 0 {
+		f.meta = meta
+	}
+	f.chunks[idx] = n
+	c.total += n
+	c.evictLocked()
+
+	return nil
+}
+
+func writeMeta(dir string, meta Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, metaFile), data, 0644)
+}
+
+// contentRangeSize returns the complete length of a Content-Range header.
+func contentRangeSize(contentRange string) (int64, error) {
+	i := strings.LastIndexByte(contentRange, '/')
+	if !strings.HasPrefix(contentRange, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || size <= 0 {
+		// unknown length ("*")
+		return 0, ErrNoRange
+	}
+
+	return size, nil
+}
+
+// prefetch fetches the chunks following idx in background,
+// as long as no reader waits for the provider.
+func (c *Cache) prefetch(f *file, idx int64) {
+	c.lock.Lock()
+	if f.prefetching {
+		c.lock.Unlock()
+		return
+	}
+	f.prefetching = true
+	f.refs++
+	c.lock.Unlock()
+
+	go func() {
+		defer func() {
+			c.lock.Lock()
+			f.prefetching = false
+			f.refs--
+			c.lock.Unlock()
+		}()
+
+		size := c.size(f)
+		for i := idx; i < idx+prefetchChunks && i*ChunkSize < size; i++ {
+			if atomic.LoadInt32(&f.waiting) > 0 {
+				return
+			}
+
+			c.lock.Lock()
+			_, ok := f.chunks[i]
+			c.lock.Unlock()
+			if ok {
+				continue
+			}
+
+			f.fetchLock.Lock()
+			c.lock.Lock()
+			_, ok = f.chunks[i]
+			c.lock.Unlock()
+			var err error
+			if !ok {
+				err = c.fetch(context.Background(), f, i)
+			}
+			f.fetchLock.Unlock()
+			if err != nil {
+				log.Printf("[iptv-proxy] %v | VOD prefetch: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+				return
+			}
+		}
+	}()
+}
+
+// size returns the size of a content, the first fetch writes it.
+func (c *Cache) size(f *file) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return f.meta.Size
+}
+
+// evictLocked removes the least recently watched contents beyond the size
+// limit, the contents being read are kept.
+func (c *Cache) evictLocked() {
+	if c.maxSize <= 0 || c.total <= c.maxSize {
+		return
+	}
+
+	names := make([]string, 0, len(c.files))
+	for name, f := range c.files {
+		if f.refs == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.files[names[i]].used.Before(c.files[names[j]].used)
+	})
+
+	for _, name := range names {
+		if c.total <= c.maxSize {
+			break
+		}
+		f := c.files[name]
+		if err := os.RemoveAll(f.dir); err != nil {
+			continue
+		}
+		for _, size := range f.chunks {
+			c.total -= size
+		}
+		delete(c.files, name)
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// Reader reads a cached content, it implements io.ReadSeeker for
+// http.ServeContent.
+type Reader struct {
+	c   *Cache
+	f   *file
+	ctx context.Context
+	off int64
+
+	// the chunk being read
+	chunk    *os.File
+	chunkIdx int64
+}
+
+// Meta returns the content metadata.
+func (r *Reader) Meta() Meta {
+	r.c.lock.Lock()
+	defer r.c.lock.Unlock()
+
+	return r.f.meta
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	size := r.c.size(r.f)
+	if r.off >= size {
+		return 0, io.EOF
+	}
+
+	idx := r.off / ChunkSize
+	if r.chunk == nil || r.chunkIdx != idx {
+		if r.chunk != nil {
+			_ = r.chunk.Close()
+			r.chunk = nil
+		}
+		path, err := r.c.chunk(r.ctx, r.f, idx)
+		if err != nil {
+			return 0, err
+		}
+		if r.chunk, err = os.Open(path); err != nil {
+			return 0, err
+		}
+		r.chunkIdx = idx
+		r.c.prefetch(r.f, idx+1)
+	}
+
+	n, err := r.chunk.ReadAt(p[:min64(int64(len(p)), (idx+1)*ChunkSize-r.off)], r.off-idx*ChunkSize)
+	r.off += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.c.size(r.f)
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+
+	return offset, nil
+}
+
+// Close releases the content, it may then be evicted.
+func (r *Reader) Close() error {
+	if r.chunk != nil {
+		_ = r.chunk.Close()
+	}
+
+	r.c.lock.Lock()
+	defer r.c.lock.Unlock()
+
+	r.f.refs--
+	r.f.used = time.Now()
+	r.c.evictLocked()
+
+	return nil
+}
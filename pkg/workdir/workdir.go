@@ -0,0 +1,330 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package workdir manages the sessions writing to the work directory
+// (HLS transcodings, timeshift buffers): one directory per session,
+// removed when the session is idle or evicted to respect a disk quota.
+package workdir
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// marks the session directories, leftovers of a previous run are removed
+const marker = ".iptv-proxy-session"
+
+const sweepInterval = 10 * time.Second
+
+// sessions used during the last seconds are being watched, they are
+// not evicted for the quota
+const busyWindow = 10 * time.Second
+
+var (
+	// ErrClosed is returned for the sessions closed or never opened.
+	ErrClosed = errors.New("workdir: session closed")
+	// ErrInvalidToken is returned for tokens not signed by the session.
+	ErrInvalidToken = errors.New("workdir: invalid token")
+)
+
+// Manager is the sessions of a work directory.
+type Manager struct {
+	dir   string
+	quota int64
+	idle  time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	dir  string
+	stop func()
+	used time.Time
+	// signs the session URLs, they are invalid once it is closed
+	key []byte
+}
+
+// New returns the sessions manager of dir, whose sessions are closed
+// when not used for idle, the oldest ones first beyond quota bytes
+// (0 for no limit).
+func New(dir string, quota int64, idle time.Duration) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		dir:      dir,
+		quota:    quota,
+		idle:     idle,
+		sessions: make(map[string]*session),
+	}
+	m.removeLeftovers()
+
+	return m, nil
+}
+
+// Open starts a session and returns its directory, stop is called when
+// it is closed. A previous session with the same id is closed, the
+// sessions opened concurrently with the same id replace each other.
+func (m *Manager) Open(id string, stop func()) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", errors.New("workdir: invalid session id")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	// not shared with the replaced sessions, removed meanwhile
+	dir, err := os.MkdirTemp(m.dir, id+".")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, marker), nil, 0644); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+
+	m.mu.Lock()
+	previous := m.sessions[id]
+	m.sessions[id] = &session{dir: dir, stop: stop, used: time.Now(), key: key}
+	m.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+
+	return dir, nil
+}
+
+// Touch marks a session as used, it returns false when it is closed.
+func (m *Manager) Touch(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.sessions[id]
+	if s == nil {
+		return false
+	}
+	s.used = time.Now()
+
+	return true
+}
+
+// Dir returns the directory of a session, false when it is closed.
+func (m *Manager) Dir(id string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.sessions[id]
+	if s == nil {
+		return "", false
+	}
+
+	return s.dir, true
+}
+
+// Sign returns the token of a session file valid until expires,
+// false when the session is closed.
+func (m *Manager) Sign(id, name string, expires time.Time) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.sessions[id]
+	if s == nil {
+		return "", false
+	}
+
+	return sign(s.key, name, expires), true
+}
+
+// Verify checks the token of a session file, the expiry is left
+// to the caller.
+func (m *Manager) Verify(id, name, token string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.sessions[id]
+	if s == nil {
+		return ErrClosed
+	}
+	if !hmac.Equal([]byte(token), []byte(sign(s.key, name, expires))) {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func sign(key []byte, name string, expires time.Time) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", name, expires.Unix())
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Close stops a session and removes its directory.
+func (m *Manager) Close(id string) {
+	m.mu.Lock()
+	s := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+
+	if s != nil {
+		s.close()
+	}
+}
+
+// close stops the session and removes its directory.
+func (s *session) close() {
+	if s.stop != nil {
+		s.stop()
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("[iptv-proxy] %v | workdir: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+	}
+}
+
+// Run closes the idle sessions and enforces the quota, until ctx is done.
+// All the sessions are closed then.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, id := range m.ids() {
+				m.Close(id)
+			}
+			return
+		case <-ticker.C:
+			m.sweep()
+		}
+	}
+}
+
+func (m *Manager) ids() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.sessions))
+	for id := range m.sessions {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func (m *Manager) sweep() {
+	type usage struct {
+		id   string
+		dir  string
+		used time.Time
+		size int64
+	}
+
+	m.mu.Lock()
+	var sessions []usage
+	var idle []string
+	for id, s := range m.sessions {
+		if time.Since(s.used) > m.idle {
+			idle = append(idle, id)
+			continue
+		}
+		sessions = append(sessions, usage{id: id, dir: s.dir, used: s.used})
+	}
+	m.mu.Unlock()
+
+	for _, id := range idle {
+		log.Printf("[iptv-proxy] %v | workdir: %s idle, closed\n", time.Now().Format("2006/01/02 - 15:04:05"), id)
+		m.Close(id)
+	}
+
+	if m.quota <= 0 {
+		return
+	}
+
+	var total int64
+	for i := range sessions {
+		sessions[i].size = dirSize(sessions[i].dir)
+		total += sessions[i].size
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].used.Before(sessions[j].used)
+	})
+	for _, s := range sessions {
+		if total <= m.quota {
+			break
+		}
+		if time.Since(s.used) < busyWindow {
+			continue
+		}
+		log.Printf("[iptv-proxy] %v | workdir: quota exceeded, %s closed\n", time.Now().Format("2006/01/02 - 15:04:05"), s.id)
+		m.Close(s.id)
+		total -= s.size
+	}
+}
+
+// removeLeftovers removes the sessions directories of a previous run,
+// the work directory may be shared.
+func (m *Manager) removeLeftovers() {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(m.dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, marker)); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[iptv-proxy] %v | workdir: %v\n", time.Now().Format("2006/01/02 - 15:04:05"), err)
+		}
+	}
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
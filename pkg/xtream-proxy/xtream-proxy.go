@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 
 	"github.com/buga1234/iptv-proxy/pkg/config"
 	xtream "github.com/tellytv/go.xtream-codes"
@@ -45,6 +46,9 @@ const (
 // Client represent an xtream client
 type Client struct {
 	*xtream.XtreamClient
+
+	// the xtream client records the streams it lists in a map
+	streamsLock sync.Mutex
 }
 
 // New new xtream client
@@ -54,17 +58,19 @@ func New(user, password, baseURL, userAgent string) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{cli}, nil
+	return &Client{XtreamClient: cli}, nil
 }
 
-type login struct {
+// Login is the response of the login action, the user info being the
+// proxy ones.
+type Login struct {
 	UserInfo   xtream.UserInfo   `json:"user_info"`
 	ServerInfo xtream.ServerInfo `json:"server_info"`
 }
 
 // Login xtream login
-func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (login, error) {
-	req := login{
+func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (Login, error) {
+	req := Login{
 		UserInfo: xtream.UserInfo{
 			Username:             proxyUser,
 			Password:             proxyPassword,
@@ -93,7 +99,7 @@ func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int,
 	return req, nil
 }
 
-// Action execute an xtream action.
+// Action execute an xtream action, it is safe for concurrent use.
 func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
 	protocol := "http"
 	if config.HTTPS {
@@ -108,7 +114,9 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 		if len(q["category_id"]) > 0 {
 			categoryID = q["category_id"][0]
 		}
+		c.streamsLock.Lock()
 		respBody, err = c.GetLiveStreams(categoryID)
+		c.streamsLock.Unlock()
 	case getVodCategories:
 		respBody, err = c.GetVideoOnDemandCategories()
 	case getVodStreams:
@@ -116,7 +124,9 @@ func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values)
 		if len(q["category_id"]) > 0 {
 			categoryID = q["category_id"][0]
 		}
+		c.streamsLock.Lock()
 		respBody, err = c.GetVideoOnDemandStreams(categoryID)
+		c.streamsLock.Unlock()
 	case getVodInfo:
 		httpcode, err = validateParams(q, "vod_id")
 		if err != nil {